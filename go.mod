@@ -1,3 +1,3 @@
 module blitiri.com.ar/go/kxd
 
-go 1.20
+go 1.21
@@ -0,0 +1,105 @@
+// Package keymem handles the memory holding key material, for kxd and kxc.
+//
+// Buffers with keys are locked in RAM, so they don't get written to swap,
+// and wiped once they are no longer needed. Core dumps can be disabled, so
+// the keys don't end up on disk that way either.
+//
+// This is best-effort: locking can fail (e.g. because of a low
+// RLIMIT_MEMLOCK), and copies we don't control (like the ones in the TLS
+// and HTTP libraries) can't be locked or wiped. Memory locking and
+// disabling core dumps are only supported on Linux.
+package keymem
+
+import (
+	"io"
+	"os"
+)
+
+// DisableCoreDumps prevents the process from dumping core, and makes it
+// non-dumpable (which also prevents other processes of the same user from
+// attaching to it or reading its memory).
+func DisableCoreDumps() error {
+	return disableCoreDumps()
+}
+
+// Lock locks the buffer's memory, so it doesn't get swapped out.
+//
+// Note locking works on whole pages, and it is not nested: wiping a buffer
+// unlocks its pages, even if another locked buffer shares one of them.
+func Lock(b []byte) error {
+	b = b[:cap(b)]
+	if len(b) == 0 {
+		return nil
+	}
+	return mlock(b)
+}
+
+// Alloc returns a new zeroed buffer of the given length, locked if
+// possible. It must be released with Wipe.
+func Alloc(n int) []byte {
+	b := make([]byte, n)
+	Lock(b)
+	return b
+}
+
+// Wipe zeroes the buffer (up to its capacity) and unlocks it. It is meant
+// for buffers from Alloc or ReadAll; others can just be cleared.
+func Wipe(b []byte) {
+	b = b[:cap(b)]
+	if len(b) == 0 {
+		return
+	}
+	clear(b)
+	munlock(b)
+}
+
+// Minimum size of the buffers used for reading, to avoid growing them
+// many times when the size is unknown.
+const minReadSize = 512
+
+// ReadAll reads from r until EOF, into a buffer from Alloc, which the
+// caller must Wipe. The expected size of the data can be given as a hint,
+// to avoid growing the buffer.
+//
+// Unlike io.ReadAll, when the buffer has to grow, the old one is wiped, so
+// no copies are left behind.
+func ReadAll(r io.Reader, sizeHint int) ([]byte, error) {
+	// One extra byte, so if the hint is right we see the EOF without
+	// having to grow.
+	buf := Alloc(max(sizeHint+1, minReadSize))
+	n := 0
+	for {
+		if n == len(buf) {
+			nbuf := Alloc(2 * len(buf))
+			copy(nbuf, buf)
+			Wipe(buf)
+			buf = nbuf
+		}
+
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return buf[:n], nil
+		}
+		if err != nil {
+			Wipe(buf)
+			return nil, err
+		}
+	}
+}
+
+// ReadFile is like os.ReadFile, but reads into a buffer from Alloc, which
+// the caller must Wipe.
+func ReadFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := 0
+	if fi, err := f.Stat(); err == nil {
+		size = int(fi.Size())
+	}
+	return ReadAll(f, size)
+}
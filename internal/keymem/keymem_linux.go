@@ -0,0 +1,33 @@
+//go:build linux
+
+package keymem
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// From <linux/prctl.h>, which the syscall package doesn't have.
+const prSetDumpable = 4
+
+func disableCoreDumps() error {
+	err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+	if err != nil {
+		return fmt.Errorf("setrlimit(RLIMIT_CORE): %v", err)
+	}
+
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_PRCTL, prSetDumpable, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_DUMPABLE): %v", errno)
+	}
+	return nil
+}
+
+func mlock(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func munlock(b []byte) error {
+	return syscall.Munlock(b)
+}
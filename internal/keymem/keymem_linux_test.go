@@ -0,0 +1,37 @@
+//go:build linux
+
+package keymem
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestDisableCoreDumps(t *testing.T) {
+	if err := DisableCoreDumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	lim := &syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, lim); err != nil {
+		t.Fatal(err)
+	}
+	if lim.Cur != 0 || lim.Max != 0 {
+		t.Errorf("RLIMIT_CORE is %+v, expected 0", lim)
+	}
+
+	// PR_GET_DUMPABLE.
+	r, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, 3, 0, 0)
+	if errno != 0 || r != 0 {
+		t.Errorf("PR_GET_DUMPABLE returned %d, %v", r, errno)
+	}
+}
+
+func TestLock(t *testing.T) {
+	b := make([]byte, 4096)
+	if err := Lock(b); err != nil {
+		// It can fail if RLIMIT_MEMLOCK is too low.
+		t.Skipf("can't lock memory: %v", err)
+	}
+	Wipe(b)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package keymem
+
+import "errors"
+
+func disableCoreDumps() error {
+	return errors.ErrUnsupported
+}
+
+func mlock(b []byte) error {
+	return errors.ErrUnsupported
+}
+
+func munlock(b []byte) error {
+	return errors.ErrUnsupported
+}
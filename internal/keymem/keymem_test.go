@@ -0,0 +1,58 @@
+package keymem
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadAll(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	for _, hint := range []int{0, 10, len(data) - 1, len(data), 10000} {
+		r := iotest.HalfReader(bytes.NewReader(data))
+		got, err := ReadAll(r, hint)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("hint %d: got %d bytes, %v",
+				hint, len(got), err)
+		}
+		Wipe(got)
+	}
+
+	errTest := errors.New("test error")
+	r := iotest.ErrReader(errTest)
+	if _, err := ReadAll(r, 0); err != errTest {
+		t.Errorf("expected %v, got %v", errTest, err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("sekrit"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil || string(got) != "sekrit" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	Wipe(got)
+
+	if _, err := ReadFile(path + ".nope"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	b := Alloc(100)
+	copy(b, "sekrit")
+	Wipe(b[:3])
+	if !bytes.Equal(b, make([]byte, 100)) {
+		t.Errorf("buffer not wiped: %q", b)
+	}
+
+	// Wiping empty or nil buffers is fine.
+	Wipe(nil)
+	Wipe([]byte{})
+}
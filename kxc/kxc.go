@@ -7,8 +7,13 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
@@ -16,8 +21,14 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
 )
 
 const defaultPort = 19840
@@ -28,6 +39,17 @@ var clientCert = flag.String(
 	"client_cert", "", "File containing the client certificate")
 var clientKey = flag.String(
 	"client_key", "", "File containing the client private key")
+var meta = flag.Bool(
+	"meta", false,
+	"Get the key's metadata (as JSON) instead of the key itself")
+var signingPubKey = flag.String(
+	"signing_pubkey", "",
+	"File with the server's ed25519 public key, in PEM format, to verify "+
+		"the key's signature with (not verified if empty)")
+var signatureMaxAge = flag.Duration(
+	"signature_max_age", 5*time.Minute,
+	"Maximum age of the key's signature; as the clocks may be off, it "+
+		"also applies to signatures from the future")
 
 func loadServerCerts() (*x509.CertPool, bool, error) {
 	pemData, err := ioutil.ReadFile(*serverCert)
@@ -80,10 +102,13 @@ func hasPort(s string) bool {
 	return strings.LastIndex(s, ":") > strings.LastIndex(s, "]")
 }
 
-func extractURL(rawurl string) (*url.URL, error) {
+// extractURL parses the URL given by the user. It returns the server URL,
+// whose path is the key (without the protocol version), and the version of
+// the protocol explicitly requested in it, if any (0 otherwise).
+func extractURL(rawurl string) (*url.URL, int, error) {
 	serverURL, err := url.Parse(rawurl)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Make sure we're using https.
@@ -93,13 +118,16 @@ func extractURL(rawurl string) (*url.URL, error) {
 	case "http", "kxd":
 		serverURL.Scheme = "https"
 	default:
-		return nil, fmt.Errorf("unsupported URL schema (try kxd://)")
+		return nil, 0, fmt.Errorf("unsupported URL schema (try kxd://)")
 	}
 
-	// The path must begin with /v1/, although we hide that from the user
-	// for forward compatibility.
-	if !strings.HasPrefix(serverURL.Path, "/v1/") {
-		serverURL.Path = "/v1" + serverURL.Path
+	// The protocol version is normally negotiated, and hidden from the
+	// user, but it can be given explicitly with a "/v1/" or "/v2/" prefix.
+	version := 0
+	if p, ok := strings.CutPrefix(serverURL.Path, "/v1/"); ok {
+		serverURL.Path, version = "/"+p, 1
+	} else if p, ok := strings.CutPrefix(serverURL.Path, "/v2/"); ok {
+		serverURL.Path, version = "/"+p, 2
 	}
 
 	// Add the default port, if none was given.
@@ -107,7 +135,90 @@ func extractURL(rawurl string) (*url.URL, error) {
 		serverURL.Host += fmt.Sprintf(":%d", defaultPort)
 	}
 
-	return serverURL, nil
+	return serverURL, version, nil
+}
+
+// sigVerifier verifies the server's signatures of the keys (see
+// --signing_pubkey).
+type sigVerifier struct {
+	pub ed25519.PublicKey
+
+	// The key path and the fingerprint of our certificate, which must
+	// match the signed ones.
+	keyPath  string
+	clientFP string
+}
+
+// Verifier for the key's signature, nil if we're not verifying it.
+var verifier *sigVerifier
+
+func loadSigningPubKey(file string) (ed25519.PublicKey, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 key")
+	}
+	return edKey, nil
+}
+
+// signedMessage returns the message the server signs for a key. This must
+// match kxd's signedMessage.
+func signedMessage(keyPath string, version int, clientFP string,
+	ts int64, keyData []byte) []byte {
+	sum := sha256.Sum256(keyData)
+	return []byte(fmt.Sprintf("kxd key signature v1\n"+
+		"path: %q\nversion: %d\nclient: %s\ntime: %d\nkey: %x\n",
+		keyPath, version, clientFP, ts, sum))
+}
+
+// verify the signature of the given key, which must have been made for us,
+// recently enough.
+func (v *sigVerifier) verify(keyData []byte, version int, ts int64,
+	sig []byte) error {
+	if len(sig) == 0 {
+		return fmt.Errorf("the key is not signed")
+	}
+
+	msg := signedMessage(v.keyPath, version, v.clientFP, ts, keyData)
+	if !ed25519.Verify(v.pub, msg, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	age := time.Since(time.Unix(ts, 0))
+	if age > *signatureMaxAge || age < -*signatureMaxAge {
+		return fmt.Errorf("signature too old (or too new), "+
+			"made at %s", time.Unix(ts, 0))
+	}
+	return nil
+}
+
+// loadClientKeyPair is like tls.LoadX509KeyPair, but it reads the private
+// key into locked memory, and wipes it once it's parsed. The parsed key
+// itself can't be wiped, as it belongs to the crypto libraries.
+func loadClientKeyPair() (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(*clientCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := keymem.ReadFile(*clientKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	defer keymem.Wipe(keyPEM)
+
+	return tls.X509KeyPair(certPEM, keyPEM)
 }
 
 func makeTLSConf() *tls.Config {
@@ -115,8 +226,7 @@ func makeTLSConf() *tls.Config {
 
 	tlsConf := &tls.Config{}
 	tlsConf.Certificates = make([]tls.Certificate, 1)
-	tlsConf.Certificates[0], err = tls.LoadX509KeyPair(
-		*clientCert, *clientKey)
+	tlsConf.Certificates[0], err = loadClientKeyPair()
 	if err != nil {
 		log.Fatalf("Failed to load keys: %s", err)
 	}
@@ -169,6 +279,10 @@ func main() {
 	var err error
 	flag.Parse()
 
+	// Keep the keys out of core dumps, as far as we can. This is
+	// best-effort, and not supported on all platforms.
+	keymem.DisableCoreDumps()
+
 	tr := &http.Transport{
 		TLSClientConfig: makeTLSConf(),
 	}
@@ -177,26 +291,208 @@ func main() {
 		Transport: tr,
 	}
 
-	serverURL, err := extractURL(flag.Arg(0))
+	serverURL, version, err := extractURL(flag.Arg(0))
 	if err != nil {
 		log.Fatalf("Failed to extract the URL: %s", err)
 	}
 
-	resp, err := client.Get(serverURL.String())
+	if *signingPubKey != "" && !*meta {
+		pub, err := loadSigningPubKey(*signingPubKey)
+		if err != nil {
+			log.Fatalf("Failed to load the signing public key: %s",
+				err)
+		}
+		cert := tr.TLSClientConfig.Certificates[0].Certificate[0]
+		sum := sha256.Sum256(cert)
+		keyPath := path.Clean(serverURL.Path)
+		verifier = &sigVerifier{
+			pub:      pub,
+			keyPath:  strings.TrimPrefix(keyPath, "/"),
+			clientFP: hex.EncodeToString(sum[:]),
+		}
+	}
+
+	if version == 0 {
+		// Try version 2 first, and fall back to version 1 if the server
+		// doesn't support it. We can tell because it replies with a
+		// plain 404, instead of a JSON error.
+		resp, content := get(client, serverURL, 2)
+		if resp.StatusCode != http.StatusNotFound || isJSON(resp) {
+			handleV2(resp, content)
+			return
+		}
+		version = 1
+	}
+
+	resp, content := get(client, serverURL, version)
+	if version == 2 {
+		handleV2(resp, content)
+	} else {
+		handleV1(resp, content)
+	}
+}
+
+// get requests the key (or its metadata) from the server, using the given
+// protocol version. It returns the response, and its body.
+func get(client *http.Client, serverURL *url.URL,
+	version int) (*http.Response, []byte) {
+	u := *serverURL
+	u.Path = fmt.Sprintf("/v%d%s", version, serverURL.Path)
+	if *meta {
+		u.RawQuery = "meta"
+	}
+
+	resp, err := client.Get(u.String())
 	if err != nil {
 		log.Fatalf("Failed to get key: %s", err)
 	}
 
-	content, err := ioutil.ReadAll(resp.Body)
+	// The body can be the key, so read it into locked memory. The handlers
+	// wipe it when done.
+	content, err := keymem.ReadAll(resp.Body, int(resp.ContentLength))
 	resp.Body.Close()
 	if err != nil {
 		log.Fatalf("Error reading key body: %s", err)
 	}
 
+	return resp, content
+}
+
+func isJSON(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	return ct == "application/json" ||
+		strings.HasPrefix(ct, "application/json;")
+}
+
+// requestID returns the ID kxd gave to the request, in the X-Request-Id
+// header, formatted for error messages ("" if there is none).
+func requestID(resp *http.Response) string {
+	if id := resp.Header.Get("X-Request-Id"); id != "" {
+		return " (request " + id + ")"
+	}
+	return ""
+}
+
+// lockedExit tells the user that access was locked by the server operator,
+// and exits. The message is made to stand out, as it's meant for whoever is
+// looking at the console.
+func lockedExit(msg string) {
+	log.Fatalf("Access locked by the server operator:\n\n    %s\n",
+		strings.TrimSpace(msg))
+}
+
+// handleV1 handles a version 1 reply: the raw key, or a plain text error.
+func handleV1(resp *http.Response, content []byte) {
+	defer keymem.Wipe(content)
+
+	if resp.StatusCode == http.StatusLocked {
+		lockedExit(string(content))
+	}
+
+	if resp.StatusCode != 200 {
+		log.Fatalf("HTTP error %q getting key%s: %s",
+			resp.Status, requestID(resp), content)
+	}
+
+	if verifier != nil {
+		ts, _ := strconv.ParseInt(
+			resp.Header.Get("X-Kxd-Key-Signature-Time"), 10, 64)
+		version, _ := strconv.Atoi(resp.Header.Get("X-Kxd-Key-Version"))
+		sig, _ := base64.StdEncoding.DecodeString(
+			resp.Header.Get("X-Kxd-Key-Signature"))
+		err := verifier.verify(content, version, ts, sig)
+		if err != nil {
+			log.Fatalf("Error verifying the key%s: %s",
+				requestID(resp), err)
+		}
+	}
+
+	// Write it directly, as fmt would leave a copy in its buffers.
+	os.Stdout.Write(content)
+}
+
+// v2Reply is the reply to version 2 requests. See kxd's reply.go for the
+// details.
+type v2Reply struct {
+	RequestID     string          `json:"request_id"`
+	Key           lockedBytes     `json:"key"`
+	KeyVersion    int             `json:"key_version"`
+	Signature     []byte          `json:"signature"`
+	SignatureTime int64           `json:"signature_time"`
+	Meta          json.RawMessage `json:"meta"`
+	Error         *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// lockedBytes is like []byte when decoding JSON (from base64), but it
+// decodes into locked memory, so it can hold a key.
+type lockedBytes []byte
+
+func (b *lockedBytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("invalid base64 value")
+	}
+	data = data[1 : len(data)-1]
+
+	buf := keymem.Alloc(base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(buf, data)
+	if err != nil {
+		keymem.Wipe(buf)
+		return err
+	}
+	*b = buf[:n]
+	return nil
+}
+
+// handleV2 handles a version 2 reply, which is always a JSON object.
+func handleV2(resp *http.Response, content []byte) {
+	defer keymem.Wipe(content)
+
+	reply := &v2Reply{}
+	defer func() { keymem.Wipe(reply.Key) }()
+	if !isJSON(resp) {
+		// Not from kxd, e.g. from a proxy in the way.
+		log.Fatalf("HTTP error %q getting key%s: %s",
+			resp.Status, requestID(resp), content)
+	}
+	if err := json.Unmarshal(content, reply); err != nil {
+		log.Fatalf("HTTP error %q getting key%s: invalid reply: %s",
+			resp.Status, requestID(resp), err)
+	}
+
+	if reply.Error != nil {
+		if reply.Error.Code == "locked" {
+			lockedExit(reply.Error.Message)
+		}
+		log.Fatalf("HTTP error %q getting key: %s (%s, request %s)",
+			resp.Status, reply.Error.Message, reply.Error.Code,
+			reply.RequestID)
+	}
+
 	if resp.StatusCode != 200 {
-		log.Fatalf("HTTP error %q getting key: %s",
-			resp.Status, content)
+		log.Fatalf("HTTP error %q getting key (request %s)",
+			resp.Status, reply.RequestID)
+	}
+
+	if *meta {
+		fmt.Printf("%s\n", reply.Meta)
+		return
+	}
+
+	if verifier != nil {
+		err := verifier.verify(reply.Key, reply.KeyVersion,
+			reply.SignatureTime, reply.Signature)
+		if err != nil {
+			log.Fatalf("Error verifying the key (request %s): %s",
+				reply.RequestID, err)
+		}
 	}
 
-	fmt.Printf("%s", content)
+	// Write it directly, as fmt would leave a copy in its buffers.
+	os.Stdout.Write(reply.Key)
 }
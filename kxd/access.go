@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// AccessRecord is a single access (or attempt) to a key.
+type AccessRecord struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	IP          string    `json:"ip"`
+
+	// Only for denials.
+	Reason string `json:"reason,omitempty"`
+}
+
+func newAccessRecord(req *Request, cert *x509.Certificate) *AccessRecord {
+	r := &AccessRecord{Time: time.Now()}
+	r.IP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	if cert != nil {
+		r.Client = cert.Subject.String()
+		r.Fingerprint = certFingerprint(cert)
+	}
+	return r
+}
+
+// KeyAccess is the access history of a key.
+type KeyAccess struct {
+	Accesses   int           `json:"accesses"`
+	LastAccess *AccessRecord `json:"last_access,omitempty"`
+
+	Denials    int           `json:"denials"`
+	LastDenial *AccessRecord `json:"last_denial,omitempty"`
+
+	// Requests for the key's metadata (see serveMeta).
+	MetaAccesses   int           `json:"meta_accesses,omitempty"`
+	LastMetaAccess *AccessRecord `json:"last_meta_access,omitempty"`
+}
+
+// AccessTracker records the access history of the keys. The records are
+// kept in a keyStateDir.
+//
+// A nil AccessTracker doesn't record anything.
+type AccessTracker struct {
+	dir keyStateDir
+
+	// Serializes the updates.
+	mu sync.Mutex
+}
+
+// The global access tracker.
+var accessTracker *AccessTracker
+
+// NewAccessTracker returns a new AccessTracker using the given directory,
+// which will be created if needed.
+func NewAccessTracker(dir string) *AccessTracker {
+	return &AccessTracker{dir: keyStateDir(dir)}
+}
+
+// Load the access history of the given key.
+func (t *AccessTracker) Load(keyPath string) (*KeyAccess, error) {
+	ka := &KeyAccess{}
+	err := t.dir.load(keyPath, ka)
+	return ka, err
+}
+
+func (t *AccessTracker) update(keyPath string, f func(ka *KeyAccess)) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ka, err := t.Load(keyPath)
+	if err != nil {
+		// Start over instead of getting stuck on a broken file.
+		logging.Printf("Error loading access history of %s: %v",
+			keyPath, err)
+		ka = &KeyAccess{}
+	}
+
+	f(ka)
+
+	if err := t.dir.save(keyPath, ka); err != nil {
+		logging.Printf("Error saving access history of %s: %v",
+			keyPath, err)
+	}
+}
+
+// RecordAccess records a successful access to the key, by the given client
+// certificate.
+func (t *AccessTracker) RecordAccess(keyPath string, req *Request,
+	cert *x509.Certificate) {
+	t.update(keyPath, func(ka *KeyAccess) {
+		ka.Accesses++
+		ka.LastAccess = newAccessRecord(req, cert)
+	})
+}
+
+// RecordMetaAccess records a successful request for the key's metadata, by
+// the given client certificate.
+func (t *AccessTracker) RecordMetaAccess(keyPath string, req *Request,
+	cert *x509.Certificate) {
+	t.update(keyPath, func(ka *KeyAccess) {
+		ka.MetaAccesses++
+		ka.LastMetaAccess = newAccessRecord(req, cert)
+	})
+}
+
+// RecordDenial records a denied request for the key.
+func (t *AccessTracker) RecordDenial(keyPath string, req *Request,
+	reason string) {
+	t.update(keyPath, func(ka *KeyAccess) {
+		var cert *x509.Certificate
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			cert = req.TLS.PeerCertificates[0]
+		}
+		ka.Denials++
+		ka.LastDenial = newAccessRecord(req, cert)
+		ka.LastDenial.Reason = reason
+	})
+}
+
+// keyStatus is the status of a key, as reported by "kxd status".
+type keyStatus struct {
+	Key string `json:"key"`
+	KeyAccess
+
+	// The key was not accessed in the last -unused_days days (or ever).
+	Unused bool `json:"unused"`
+}
+
+func cmdStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Output in JSON format")
+	unusedDays := flags.Int("unused_days", 90,
+		"Flag keys not accessed in this many days")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments")
+	}
+
+	keys, err := NewDirStore(*dataDir).Keys()
+	if err != nil {
+		return err
+	}
+
+	tracker := NewAccessTracker(path.Join(*stateDir, "access"))
+	cutoff := time.Now().AddDate(0, 0, -*unusedDays)
+	statuses := []*keyStatus{}
+	for _, key := range keys {
+		ka, err := tracker.Load(key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		statuses = append(statuses, &keyStatus{
+			Key:       key,
+			KeyAccess: *ka,
+			Unused: ka.LastAccess == nil ||
+				ka.LastAccess.Time.Before(cutoff),
+		})
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\tACCESSES\tLAST ACCESS\tCLIENT\tIP\t"+
+		"DENIALS\tLAST DENIAL\tNOTES\n")
+	for _, s := range statuses {
+		last, client, ip := "never", "-", "-"
+		if s.LastAccess != nil {
+			last = s.LastAccess.Time.Format("2006-01-02 15:04")
+			client = s.LastAccess.Client
+			ip = s.LastAccess.IP
+		}
+		lastDenial := "never"
+		if s.LastDenial != nil {
+			lastDenial = s.LastDenial.Time.Format("2006-01-02 15:04")
+		}
+
+		notes := []string{}
+		if s.LastAccess == nil {
+			notes = append(notes, "never used")
+		} else if s.Unused {
+			notes = append(notes,
+				fmt.Sprintf("unused in %d days", *unusedDays))
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			s.Key, s.Accesses, last, client, ip,
+			s.Denials, lastDenial, strings.Join(notes, ", "))
+	}
+	return tw.Flush()
+}
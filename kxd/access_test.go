@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestAccessTracker(t *testing.T) {
+	tr := NewAccessTracker(t.TempDir())
+	cert := newTestCert(t, "client").Leaf
+	req := newTestRequest("host/key", "192.0.2.1:1234")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	ka, err := tr.Load("host/key")
+	if err != nil || ka.Accesses != 0 || ka.LastAccess != nil {
+		t.Errorf("unexpected history for unused key: %+v, %v", ka, err)
+	}
+
+	tr.RecordAccess("host/key", req, cert)
+	tr.RecordAccess("host/key", req, cert)
+	tr.RecordDenial("host/key", req, "Host not allowed")
+
+	// Use a new tracker, to check the records are persisted.
+	tr = NewAccessTracker(string(tr.dir))
+	ka, err = tr.Load("host/key")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if ka.Accesses != 2 || ka.Denials != 1 {
+		t.Errorf("unexpected counts: %+v", ka)
+	}
+	if r := ka.LastAccess; r == nil || r.IP != "192.0.2.1" ||
+		r.Client != "O=client" || r.Fingerprint != certFingerprint(cert) {
+		t.Errorf("unexpected last access: %+v", r)
+	}
+	if r := ka.LastDenial; r == nil || r.Reason != "Host not allowed" {
+		t.Errorf("unexpected last denial: %+v", r)
+	}
+
+	// A nil tracker doesn't record anything (but doesn't fail either).
+	tr = nil
+	tr.RecordAccess("host/key", req, cert)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var authzURL = flag.String(
+	"authz_url", "",
+	"URL of an external authorization service to consult before "+
+		"authorizing keys (disabled if empty)")
+var authzSocket = flag.String(
+	"authz_socket", "",
+	"Unix socket to reach the authorization service through, instead of "+
+		"connecting to the host in --authz_url")
+var authzFailOpen = flag.Bool(
+	"authz_fail_open", false,
+	"Allow requests if the authorization service fails to give a decision")
+var authzTimeout = flag.Duration(
+	"authz_timeout", 10*time.Second,
+	"Timeout for requests to the authorization service")
+var authzCA = flag.String(
+	"authz_ca", "",
+	"File with the CA certificates to verify the authorization service "+
+		"(defaults to the system's)")
+var authzCert = flag.String(
+	"authz_cert", "",
+	"Client certificate to present to the authorization service")
+var authzKey = flag.String(
+	"authz_key", "",
+	"Private key for --authz_cert")
+var authzCacheTTL = flag.Duration(
+	"authz_cache_ttl", 0,
+	"How long to cache authorization decisions for (0 to disable)")
+
+// The global authorizer, nil if not configured.
+var authorizer *Authorizer
+
+var errAuthzDenied = errors.New("denied")
+
+// authzRequest is what we send to the authorization service. It's the same
+// information the hook gets, plus the client certificate fingerprint, which
+// is usually more convenient for policies.
+type authzRequest struct {
+	hookRequest
+	ClientCertFingerprint string `json:"client_cert_fingerprint"`
+}
+
+// authzDecision is the response from the authorization service.
+type authzDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+type authzCacheEntry struct {
+	decision authzDecision
+	expires  time.Time
+}
+
+// Authorizer asks an external service for authorization decisions, over
+// HTTP(S) or a Unix socket.
+//
+// For each request, it POSTs a JSON object (see authzRequest) to the URL.
+// The service must reply with 200 and a JSON object like
+// {"allow": true, "reason": "..."}. A 403 reply is also taken as a denial.
+// Anything else is an error, and the request is allowed or denied depending
+// on FailOpen.
+type Authorizer struct {
+	URL      string
+	FailOpen bool
+	CacheTTL time.Duration
+
+	client *http.Client
+
+	// Cache of decisions, protected by cacheMu.
+	cacheMu sync.Mutex
+	cache   map[string]authzCacheEntry
+}
+
+// NewAuthorizer creates a new Authorizer. If socket is not empty, all
+// connections go to that Unix socket, regardless of the URL's host.
+func NewAuthorizer(url, socket string, tlsConf *tls.Config,
+	timeout time.Duration) *Authorizer {
+	tr := &http.Transport{
+		TLSClientConfig: tlsConf,
+	}
+	if socket != "" {
+		dialer := &net.Dialer{}
+		tr.DialContext = func(ctx context.Context, _, _ string) (
+			net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	return &Authorizer{
+		URL: url,
+		client: &http.Client{
+			Transport: tr,
+			Timeout:   timeout,
+		},
+		cache: map[string]authzCacheEntry{},
+	}
+}
+
+// NewAuthorizerFromFlags creates a new Authorizer based on the command line
+// flags.
+func NewAuthorizerFromFlags() (*Authorizer, error) {
+	tlsConf := &tls.Config{}
+	if *authzCA != "" {
+		pemData, err := os.ReadFile(*authzCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("error parsing %q", *authzCA)
+		}
+	}
+	if *authzCert != "" {
+		cert, err := tls.LoadX509KeyPair(*authzCert, *authzKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	a := NewAuthorizer(*authzURL, *authzSocket, tlsConf, *authzTimeout)
+	a.FailOpen = *authzFailOpen
+	a.CacheTTL = *authzCacheTTL
+	return a, nil
+}
+
+// Check asks the authorization service about the request, returns an error
+// if the request is not allowed.
+func (a *Authorizer) Check(kc *KeyConfig, req *Request,
+	chains [][]*x509.Certificate) error {
+	hr, err := newHookRequest(kc, req, chains)
+	if err != nil {
+		return err
+	}
+	ar := &authzRequest{
+		hookRequest:           *hr,
+		ClientCertFingerprint: certFingerprint(chains[0][0]),
+	}
+
+	// The port changes on every connection, so leave it out of the cache
+	// key.
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	cacheKey := fmt.Sprintf("%s\x00%s\x00%s\x00%v", ar.KeyPath, host,
+		ar.ClientCertFingerprint, ar.Meta)
+
+	decision, ok := a.fromCache(cacheKey)
+	if !ok {
+		decision, err = a.query(ar)
+		if err != nil {
+			if a.FailOpen {
+				req.Printf("Authorizer failed, allowing: %s", err)
+				return nil
+			}
+			return err
+		}
+		a.toCache(cacheKey, decision)
+	}
+
+	if !decision.Allow {
+		return fmt.Errorf("%w: %q", errAuthzDenied, decision.Reason)
+	}
+	return nil
+}
+
+func (a *Authorizer) query(ar *authzRequest) (authzDecision, error) {
+	decision := authzDecision{}
+
+	body, err := json.Marshal(ar)
+	if err != nil {
+		return decision, err
+	}
+
+	resp, err := a.client.Post(a.URL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+
+	// Limit the size, a decision should be tiny.
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return decision, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.Unmarshal(respBody, &decision)
+		if err != nil {
+			return decision, fmt.Errorf("invalid response: %v", err)
+		}
+	case http.StatusForbidden:
+		// The body is optional in this case.
+		json.Unmarshal(respBody, &decision)
+		decision.Allow = false
+	default:
+		return decision, fmt.Errorf("unexpected status %q",
+			resp.Status)
+	}
+
+	return decision, nil
+}
+
+func (a *Authorizer) fromCache(key string) (authzDecision, bool) {
+	if a.CacheTTL <= 0 {
+		return authzDecision{}, false
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	e, ok := a.cache[key]
+	if !ok {
+		return authzDecision{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(a.cache, key)
+		return authzDecision{}, false
+	}
+	return e.decision, true
+}
+
+func (a *Authorizer) toCache(key string, decision authzDecision) {
+	if a.CacheTTL <= 0 {
+		return
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	now := time.Now()
+	for k, e := range a.cache {
+		if now.After(e.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = authzCacheEntry{decision, now.Add(a.CacheTTL)}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// authzStub is a fake authorization service, which allows requests to the
+// "allowed" key, and denies everything else.
+type authzStub struct {
+	calls    atomic.Int32
+	lastReq  authzRequest
+	failWith int
+}
+
+func (s *authzStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls.Add(1)
+	if s.failWith != 0 {
+		http.Error(w, "failing on purpose", s.failWith)
+		return
+	}
+
+	s.lastReq = authzRequest{}
+	json.NewDecoder(r.Body).Decode(&s.lastReq)
+
+	switch s.lastReq.KeyPath {
+	case "allowed":
+		json.NewEncoder(w).Encode(authzDecision{Allow: true})
+	case "forbidden":
+		w.WriteHeader(http.StatusForbidden)
+	case "garbage":
+		w.Write([]byte("not json"))
+	default:
+		json.NewEncoder(w).Encode(
+			authzDecision{Allow: false, Reason: "go away"})
+	}
+}
+
+// The client certificate used in checkAuthz, generated on first use and
+// kept so the cache key doesn't change between checks.
+var authzTestCert *x509.Certificate
+
+func checkAuthz(t *testing.T, a *Authorizer, key string) error {
+	t.Helper()
+	if authzTestCert == nil {
+		authzTestCert = newTestCert(t, "client").Leaf
+	}
+	req := newTestRequest(key, "192.0.2.1:1234")
+	kc := NewKeyConfig(NewMemStore(), key)
+	return a.Check(kc, req, [][]*x509.Certificate{{authzTestCert}})
+}
+
+func TestAuthorizer(t *testing.T) {
+	stub := &authzStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := NewAuthorizer(srv.URL, "", nil, time.Second)
+
+	if err := checkAuthz(t, a, "allowed"); err != nil {
+		t.Errorf("allowed key was denied: %v", err)
+	}
+	if stub.lastReq.RemoteAddr != "192.0.2.1:1234" ||
+		len(stub.lastReq.ClientCertFingerprint) != 64 ||
+		len(stub.lastReq.Chains) != 1 {
+		t.Errorf("unexpected request: %+v", stub.lastReq)
+	}
+
+	for _, key := range []string{"denied", "forbidden"} {
+		err := checkAuthz(t, a, key)
+		if !errors.Is(err, errAuthzDenied) {
+			t.Errorf("%q: expected denial, got %v", key, err)
+		}
+	}
+
+	// Invalid responses are errors, not denials.
+	err := checkAuthz(t, a, "garbage")
+	if err == nil || errors.Is(err, errAuthzDenied) {
+		t.Errorf("garbage: expected error, got %v", err)
+	}
+
+	// Without caching, every check results in a call.
+	if n := stub.calls.Load(); n != 4 {
+		t.Errorf("expected 4 calls, got %d", n)
+	}
+}
+
+func TestAuthorizerFailOpenClosed(t *testing.T) {
+	stub := &authzStub{failWith: http.StatusInternalServerError}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := NewAuthorizer(srv.URL, "", nil, time.Second)
+	if err := checkAuthz(t, a, "allowed"); err == nil {
+		t.Errorf("fail closed: expected error, got nil")
+	}
+
+	a.FailOpen = true
+	if err := checkAuthz(t, a, "allowed"); err != nil {
+		t.Errorf("fail open: expected nil, got %v", err)
+	}
+
+	// Explicit denials must be respected even when failing open.
+	stub.failWith = 0
+	if err := checkAuthz(t, a, "denied"); err == nil {
+		t.Errorf("fail open: denial was ignored")
+	}
+
+	// Unreachable service.
+	srv.Close()
+	if err := checkAuthz(t, a, "allowed"); err != nil {
+		t.Errorf("fail open, unreachable: expected nil, got %v", err)
+	}
+	a.FailOpen = false
+	if err := checkAuthz(t, a, "allowed"); err == nil {
+		t.Errorf("fail closed, unreachable: expected error, got nil")
+	}
+}
+
+func TestAuthorizerCache(t *testing.T) {
+	stub := &authzStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	a := NewAuthorizer(srv.URL, "", nil, time.Second)
+	a.CacheTTL = 200 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		checkAuthz(t, a, "allowed")
+		checkAuthz(t, a, "denied")
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+
+	// Denials are cached too.
+	if err := checkAuthz(t, a, "denied"); err == nil {
+		t.Errorf("cached denial was allowed")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	checkAuthz(t, a, "allowed")
+	if n := stub.calls.Load(); n != 3 {
+		t.Errorf("expected 3 calls after expiry, got %d", n)
+	}
+}
+
+func TestAuthorizerUnixSocket(t *testing.T) {
+	sockPath := t.TempDir() + "/authz.sock"
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &authzStub{}
+	srv := httptest.NewUnstartedServer(stub)
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	a := NewAuthorizer("http://authz/check", sockPath, nil, time.Second)
+	if err := checkAuthz(t, a, "allowed"); err != nil {
+		t.Errorf("allowed key was denied: %v", err)
+	}
+	if err := checkAuthz(t, a, "denied"); err == nil {
+		t.Errorf("denied key was allowed")
+	}
+}
+
+func TestAuthorizerMutualTLS(t *testing.T) {
+	clientCert := newTestCert(t, "kxd")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	stub := &authzStub{}
+	srv := httptest.NewUnstartedServer(stub)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	// Without a client certificate, the service rejects us.
+	a := NewAuthorizer(srv.URL, "", &tls.Config{RootCAs: roots}, time.Second)
+	if err := checkAuthz(t, a, "allowed"); err == nil {
+		t.Errorf("expected error without client certificate")
+	}
+
+	a = NewAuthorizer(srv.URL, "", &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}, time.Second)
+	if err := checkAuthz(t, a, "allowed"); err != nil {
+		t.Errorf("allowed key was denied: %v", err)
+	}
+}
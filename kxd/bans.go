@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var banThreshold = flag.Int(
+	"ban_threshold", 0,
+	"Number of denied requests within --ban_window after which the IP "+
+		"address or client certificate gets banned (0 to disable bans)")
+var banWindow = flag.Duration(
+	"ban_window", 10*time.Minute,
+	"Window in which denied requests are counted towards a ban")
+var banDuration = flag.Duration(
+	"ban_duration", 1*time.Hour, "How long bans last")
+
+var alertEmailTo stringList
+
+func init() {
+	flag.Var(&alertEmailTo, "alert_email_to",
+		"Email address to send alerts (like bans) to (can be repeated)")
+}
+
+// Ban is a temporary ban of a source: an IP address ("ip-<address>"), or a
+// client certificate ("cert-<fingerprint>").
+type Ban struct {
+	Source  string    `json:"source"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Denials int       `json:"denials"`
+
+	// Reason for the last denial before the ban.
+	LastReason string `json:"last_reason"`
+}
+
+func (b *Ban) String() string {
+	return fmt.Sprintf("%s banned until %s, after %d denied requests "+
+		"(last: %s)", b.Source, b.Until.Format(time.RFC1123Z),
+		b.Denials, b.LastReason)
+}
+
+// BanList keeps track of the denied requests, and of the banned sources.
+//
+// The bans are stored as JSON files in the bans directory, one per source,
+// so they survive restarts and can be removed externally (e.g. with "kxd
+// unban"). They're read on every check, which is cheap enough for our
+// request rates.
+//
+// A nil BanList never bans anything.
+type BanList struct {
+	dir string
+
+	// Times of the recent denials, per source, protected by mu.
+	mu          sync.Mutex
+	denials     map[string][]time.Time
+	lastCleanup time.Time
+}
+
+// The global ban list.
+var bans *BanList
+
+// NewBanList returns a new BanList using the given directory, which will be
+// created if needed.
+func NewBanList(dir string) *BanList {
+	return &BanList{
+		dir:     dir,
+		denials: map[string][]time.Time{},
+	}
+}
+
+func ipSource(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return "ip-" + host
+}
+
+func certSource(cert *x509.Certificate) string {
+	return "cert-" + certFingerprint(cert)
+}
+
+// requestSources returns the sources of the request: its IP address, and its
+// client certificate if it has one.
+func requestSources(req *Request) []string {
+	sources := []string{ipSource(req.RemoteAddr)}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		sources = append(sources,
+			certSource(req.TLS.PeerCertificates[0]))
+	}
+	return sources
+}
+
+func (b *BanList) path(source string) string {
+	return filepath.Join(b.dir, source+".json")
+}
+
+// Record a denied request from the given sources. The ones which reach the
+// threshold get banned, and the new bans are returned.
+func (b *BanList) Record(sources []string, reason string,
+	now time.Time) []*Ban {
+	if b == nil || *banThreshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Sub(b.lastCleanup) > *banWindow {
+		for source, times := range b.denials {
+			if now.Sub(times[len(times)-1]) > *banWindow {
+				delete(b.denials, source)
+			}
+		}
+		b.lastCleanup = now
+	}
+
+	newBans := []*Ban{}
+	for _, source := range sources {
+		times := append(b.denials[source], now)
+		for len(times) > 0 && now.Sub(times[0]) > *banWindow {
+			times = times[1:]
+		}
+
+		if len(times) < *banThreshold {
+			b.denials[source] = times
+			continue
+		}
+
+		// Start over once the ban is in place, so it doesn't get renewed
+		// right away when it expires.
+		delete(b.denials, source)
+
+		ban := &Ban{
+			Source:     source,
+			Since:      now,
+			Until:      now.Add(*banDuration),
+			Denials:    len(times),
+			LastReason: reason,
+		}
+		buf, _ := json.Marshal(ban)
+		if err := writeFileAtomic(b.path(source), buf); err != nil {
+			logging.Printf("Error saving ban of %s: %v", source, err)
+		}
+		newBans = append(newBans, ban)
+	}
+	return newBans
+}
+
+// Banned returns the ban for the given source, or nil if it's not banned.
+// Expired bans are removed.
+func (b *BanList) Banned(source string, now time.Time) *Ban {
+	if b == nil {
+		return nil
+	}
+
+	ban, err := readBan(b.path(source))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Printf("Error reading ban of %s: %v", source, err)
+		}
+		return nil
+	}
+
+	if now.After(ban.Until) {
+		os.Remove(b.path(source))
+		return nil
+	}
+	return ban
+}
+
+func readBan(path string) (*Ban, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ban := &Ban{}
+	err = json.Unmarshal(buf, ban)
+	return ban, err
+}
+
+// CheckRequest returns the ban for any of the request's sources, or nil if
+// none of them is banned.
+func (b *BanList) CheckRequest(req *Request) *Ban {
+	for _, source := range requestSources(req) {
+		if ban := b.Banned(source, time.Now()); ban != nil {
+			return ban
+		}
+	}
+	return nil
+}
+
+// CheckHello can be used as tls.Config.GetConfigForClient, to reject
+// connections from banned IP addresses as early as possible.
+func (b *BanList) CheckHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	source := ipSource(hello.Conn.RemoteAddr().String())
+	if ban := b.Banned(source, time.Now()); ban != nil {
+		return nil, fmt.Errorf("%s is banned until %s",
+			source, ban.Until.Format(time.RFC1123Z))
+	}
+	return nil, nil
+}
+
+// CheckConnection can be used as tls.Config.VerifyConnection, to reject
+// banned client certificates during the handshake.
+func (b *BanList) CheckConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	source := certSource(cs.PeerCertificates[0])
+	if ban := b.Banned(source, time.Now()); ban != nil {
+		return fmt.Errorf("%s is banned until %s",
+			source, ban.Until.Format(time.RFC1123Z))
+	}
+	return nil
+}
+
+// List returns the active bans, sorted by source.
+func (b *BanList) List(now time.Time) ([]*Ban, error) {
+	entries, err := os.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := []*Ban{}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ban, err := readBan(filepath.Join(b.dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if now.Before(ban.Until) {
+			list = append(list, ban)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Source < list[j].Source
+	})
+	return list, nil
+}
+
+// Remove the ban of the given source. It can also be given as just an IP
+// address.
+func (b *BanList) Remove(source string) error {
+	if ip := net.ParseIP(source); ip != nil {
+		source = "ip-" + source
+	}
+	if !strings.HasPrefix(source, "ip-") &&
+		!strings.HasPrefix(source, "cert-") ||
+		strings.ContainsAny(source, `/\`) {
+		return fmt.Errorf("invalid source %q", source)
+	}
+
+	err := os.Remove(b.path(source))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not banned", source)
+	}
+	return err
+}
+
+// alertBan queues the alerts for the new ban, triggered by the given
+// request. They go to the global webhooks, and to --alert_email_to.
+func alertBan(ban *Ban, req *Request) {
+	ev := &Event{
+		Type:   EventSourceBanned,
+		Time:   ban.Since,
+		Req:    req,
+		Reason: ban.String(),
+		Ban:    ban,
+	}
+	ev.Key, _ = req.KeyPath()
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		ev.Cert = req.TLS.PeerCertificates[0]
+		ev.Chains = [][]*x509.Certificate{req.TLS.PeerCertificates}
+	}
+
+	ds, err := webhookDeliveries(webhookURLs, ev)
+	if err != nil {
+		req.Printf("Error composing ban alert: %s", err)
+		return
+	}
+
+	if len(alertEmailTo) > 0 && mailEnabled() {
+		ds = append(ds, &delivery{
+			Kind: "email",
+			From: *emailFrom,
+			To:   alertEmailTo,
+			Data: composeAlertMail(ev),
+		})
+	}
+
+	for _, d := range ds {
+		req.Printf("Queueing ban alert: %s", d)
+		if err := notifySpool.Add(d); err != nil {
+			req.Printf("Error queueing ban alert: %s", err)
+		}
+	}
+}
+
+// composeAlertMail composes the email for an alert. Unlike key
+// notifications, these go to the administrators and so are not
+// customizable.
+func composeAlertMail(ev *Event) []byte {
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "Date: %s\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "From: Key Exchange Daemon <%s>\n", *emailFrom)
+	fmt.Fprintf(msg, "To: %s\n", strings.Join(alertEmailTo, ", "))
+	fmt.Fprintf(msg, "Subject: kxd alert: %s banned\n\n", ev.Ban.Source)
+
+	fmt.Fprintf(msg, "%s\n\n", ev.Reason)
+	fmt.Fprintf(msg, "Last request: %s from %s\n",
+		ev.Req.URL.Path, ev.Req.RemoteAddr)
+	if ev.Cert != nil {
+		fmt.Fprintf(msg, "Client certificate: %s\n", certToString(ev.Cert))
+	}
+	fmt.Fprintf(msg, "\nTo lift the ban: kxd unban %s\n", ev.Ban.Source)
+	return msg.Bytes()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func setBanFlags(t *testing.T, threshold int) {
+	t.Helper()
+	oldThreshold, oldWindow, oldDuration :=
+		*banThreshold, *banWindow, *banDuration
+	*banThreshold = threshold
+	*banWindow = 10 * time.Minute
+	*banDuration = 1 * time.Hour
+	t.Cleanup(func() {
+		*banThreshold, *banWindow, *banDuration =
+			oldThreshold, oldWindow, oldDuration
+	})
+}
+
+func TestBans(t *testing.T) {
+	setBanFlags(t, 3)
+	b := NewBanList(t.TempDir())
+	now := time.Now()
+
+	ip := ipSource("192.0.2.1:1234")
+	cert := certSource(newTestCert(t, "client").Leaf)
+
+	// Denials outside of the window don't count.
+	b.Record([]string{ip, cert}, "old", now.Add(-20*time.Minute))
+
+	if bs := b.Record([]string{ip, cert}, "r1", now); len(bs) != 0 {
+		t.Errorf("unexpected bans after 1 denial: %v", bs)
+	}
+	if bs := b.Record([]string{ip}, "r2", now.Add(time.Minute)); len(bs) != 0 {
+		t.Errorf("unexpected bans after 2 denials: %v", bs)
+	}
+
+	bs := b.Record([]string{ip, cert}, "r3", now.Add(2*time.Minute))
+	if len(bs) != 1 || bs[0].Source != ip || bs[0].Denials != 3 ||
+		bs[0].LastReason != "r3" {
+		t.Fatalf("unexpected bans after 3 denials: %v", bs)
+	}
+
+	if ban := b.Banned(ip, now.Add(3*time.Minute)); ban == nil {
+		t.Errorf("%s not banned", ip)
+	}
+	if ban := b.Banned(cert, now.Add(3*time.Minute)); ban != nil {
+		t.Errorf("%s banned: %v", cert, ban)
+	}
+
+	// Bans survive restarts.
+	b = NewBanList(b.dir)
+	list, err := b.List(now.Add(3 * time.Minute))
+	if err != nil || len(list) != 1 || list[0].Source != ip {
+		t.Errorf("List: %v, %v", list, err)
+	}
+
+	// And they expire.
+	if ban := b.Banned(ip, now.Add(2*time.Hour)); ban != nil {
+		t.Errorf("%s still banned: %v", ip, ban)
+	}
+	if list, _ := b.List(now); len(list) != 0 {
+		t.Errorf("expired ban still listed: %v", list)
+	}
+}
+
+func TestBansDisabled(t *testing.T) {
+	setBanFlags(t, 0)
+	b := NewBanList(t.TempDir())
+	for i := 0; i < 100; i++ {
+		bs := b.Record([]string{"ip-192.0.2.1"}, "r", time.Now())
+		if len(bs) != 0 {
+			t.Fatalf("unexpected bans with bans disabled: %v", bs)
+		}
+	}
+
+	// A nil list never bans anything.
+	b = nil
+	if ban := b.Banned("ip-192.0.2.1", time.Now()); ban != nil {
+		t.Errorf("nil list banned: %v", ban)
+	}
+}
+
+func TestUnban(t *testing.T) {
+	setBanFlags(t, 1)
+	b := NewBanList(t.TempDir())
+
+	cert := newTestCert(t, "client").Leaf
+	req := newTestRequest("key", "192.0.2.1:1234")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+	b.Record(requestSources(req), "r", time.Now())
+
+	if ban := b.CheckRequest(req); ban == nil {
+		t.Fatalf("request not banned")
+	}
+	if err := b.CheckConnection(*req.TLS); err == nil {
+		t.Errorf("connection not banned")
+	}
+
+	// IPs can be given directly.
+	if err := b.Remove("192.0.2.1"); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	if err := b.Remove(certSource(cert)); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	if ban := b.CheckRequest(req); ban != nil {
+		t.Errorf("request still banned: %v", ban)
+	}
+
+	for _, source := range []string{"ip-192.0.2.1", "blah", "ip-../x"} {
+		if err := b.Remove(source); err == nil {
+			t.Errorf("Remove(%q) did not fail", source)
+		}
+	}
+}
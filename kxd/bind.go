@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Modes for binding the client certificates to the clients' IP addresses,
+// set per key in the bind_client_ip file.
+const (
+	// The client's IP address must be in the certificate's IP SANs.
+	bindIPSAN = "ip_san"
+
+	// The forward-confirmed reverse DNS name of the client's IP address
+	// must match one of the certificate's DNS SANs.
+	bindFCrDNS = "fcrdns"
+)
+
+// Resolver functions, which can be overridden for testing.
+var (
+	lookupAddr = net.LookupAddr
+	lookupHost = net.LookupHost
+)
+
+// BindClientIP returns how the client certificates must be bound to the
+// clients' IP addresses for this key, or "" if they don't need to be.
+func (kc *KeyConfig) BindClientIP() (string, error) {
+	contents, err := kc.readFile("bind_client_ip")
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch mode := strings.TrimSpace(string(contents)); mode {
+	case bindIPSAN, bindFCrDNS:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown bind_client_ip mode %q", mode)
+	}
+}
+
+// checkClientIP checks that the client certificate is bound to the given
+// address, using the given mode (see BindClientIP). An empty mode allows
+// everything.
+func checkClientIP(mode, addr string, cert *x509.Certificate) error {
+	if mode == "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid client address %q", host)
+	}
+
+	switch mode {
+	case bindIPSAN:
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not in the certificate's IP SANs", ip)
+	case bindFCrDNS:
+		names, err := fcrdns(ip)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if cert.VerifyHostname(name) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no name of %s matches the certificate's "+
+			"DNS SANs (confirmed names: %v)", ip, names)
+	default:
+		return fmt.Errorf("unknown bind_client_ip mode %q", mode)
+	}
+}
+
+// fcrdns returns the forward-confirmed reverse DNS names of the given IP
+// address: its reverse DNS names, which in turn resolve back to it.
+func fcrdns(ip net.IP) ([]string, error) {
+	names, err := lookupAddr(ip.String())
+	if err != nil {
+		return nil, fmt.Errorf("reverse lookup of %s: %v", ip, err)
+	}
+
+	confirmed := []string{}
+	for _, name := range names {
+		addrs, err := lookupHost(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				confirmed = append(confirmed,
+					strings.TrimSuffix(name, "."))
+				break
+			}
+		}
+	}
+	return confirmed, nil
+}
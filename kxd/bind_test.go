@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBindClientIP(t *testing.T) {
+	s := NewMemStore()
+	s.Set("k1", "key", []byte("k1"))
+	s.Set("k2", "key", []byte("k2"))
+	s.Set("k2", "bind_client_ip", []byte("ip_san\n"))
+	s.Set("k3", "key", []byte("k3"))
+	s.Set("k3", "bind_client_ip", []byte("fcrdns\n"))
+	s.Set("k4", "key", []byte("k4"))
+	s.Set("k4", "bind_client_ip", []byte("something\n"))
+
+	cases := []struct {
+		key, mode string
+		err       bool
+	}{
+		{"k1", "", false},
+		{"k2", bindIPSAN, false},
+		{"k3", bindFCrDNS, false},
+		{"k4", "", true},
+	}
+	for _, c := range cases {
+		mode, err := NewKeyConfig(s, c.key).BindClientIP()
+		if mode != c.mode || (err != nil) != c.err {
+			t.Errorf("%s: got %q, %v; want %q, error %v",
+				c.key, mode, err, c.mode, c.err)
+		}
+	}
+}
+
+func TestCheckClientIP(t *testing.T) {
+	// The test certificate has 127.0.0.1 as IP SAN, and localhost as DNS
+	// SAN.
+	cert := newTestCert(t, "client").Leaf
+
+	dns := map[string][]string{
+		"127.0.0.1":  {"localhost."},
+		"localhost.": {"::1", "127.0.0.1"},
+
+		// The reverse name doesn't resolve back to the address.
+		"192.0.2.1": {"localhost."},
+
+		// The reverse name doesn't match the certificate.
+		"192.0.2.2":         {"host.example.com."},
+		"host.example.com.": {"192.0.2.2"},
+	}
+	lookup := func(name string) ([]string, error) {
+		if r, ok := dns[name]; ok {
+			return r, nil
+		}
+		return nil, errors.New("not found")
+	}
+	setFlag(t, &lookupAddr, lookup)
+	setFlag(t, &lookupHost, lookup)
+
+	cases := []struct {
+		mode, addr string
+		ok         bool
+	}{
+		{"", "192.0.2.1:1234", true},
+		{bindIPSAN, "127.0.0.1:1234", true},
+		{bindIPSAN, "[::ffff:127.0.0.1]:1234", true},
+		{bindIPSAN, "192.0.2.1:1234", false},
+		{bindFCrDNS, "127.0.0.1:1234", true},
+		{bindFCrDNS, "192.0.2.1:1234", false},
+		{bindFCrDNS, "192.0.2.2:1234", false},
+		{bindFCrDNS, "192.0.2.3:1234", false},
+		{bindIPSAN, "invalid", false},
+		{"unknown", "127.0.0.1:1234", false},
+	}
+	for _, c := range cases {
+		err := checkClientIP(c.mode, c.addr, cert)
+		if (err == nil) != c.ok {
+			t.Errorf("checkClientIP(%q, %q) = %v, expected ok: %v",
+				c.mode, c.addr, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// command is an administrative command, run as "kxd [flags] <command>
+// [args]" instead of starting the daemon.
+//
+// Commands work directly on the data and state directories, so they can be
+// used while the daemon is running.
+type command struct {
+	name string
+	args string
+	help string
+	run  func(args []string) error
+}
+
+var commands = []*command{
+	{"explain", "<key>",
+		"Show the configuration in effect for the key", cmdExplain},
+	{"check", "[<key>...]",
+		"Check the configuration of the keys (all by default), and " +
+			"show where their policy files come from", cmdCheck},
+	{"status", "[-json] [-unused_days N]",
+		"Show the access history of all the keys, flagging the " +
+			"ones not used recently", cmdStatus},
+	{"bans", "", "List the active bans", cmdBans},
+	{"unban", "<source>",
+		"Lift the ban of the source (as listed by 'bans', " +
+			"or an IP address)", cmdUnban},
+	{"reset-limits", "<key>",
+		"Forget the accesses to the key, so its limits start over",
+		cmdResetLimits},
+	{"lock", "all|key <key>|client <fingerprint or cert file> <message>",
+		"Lock the whole server, a key, or a client certificate; " +
+			"requests will be denied with the message", cmdLock},
+	{"unlock", "all|key <key>|client <fingerprint or cert file>",
+		"Remove a lock", cmdUnlock},
+	{"locks", "", "List the locks", cmdLocks},
+}
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: kxd [flags] [command [args]]\n\n")
+	fmt.Fprintf(out, "Without a command, runs the daemon. Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n",
+			strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the command given in the arguments, and exits.
+func runCommand(args []string) {
+	// Commands report errors directly to the user.
+	logging = log.New(os.Stderr, "", 0)
+
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		if err := c.run(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "kxd %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	fmt.Fprintf(os.Stderr, "kxd: unknown command %q\n\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+// cleanKeyPath returns the given key path in the same form as in the
+// requests (e.g. "host/key"), or an error if it's not valid.
+func cleanKeyPath(key string) (string, error) {
+	keyPath := strings.Trim(path.Clean(key), "/")
+	if strings.Contains(keyPath, "..") || keyPath == "." {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return keyPath, nil
+}
+
+func cmdBans(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("unexpected arguments")
+	}
+
+	list, err := NewBanList(path.Join(*stateDir, "bans")).List(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, ban := range list {
+		fmt.Println(ban)
+	}
+	return nil
+}
+
+func cmdUnban(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one source")
+	}
+	return NewBanList(path.Join(*stateDir, "bans")).Remove(args[0])
+}
+
+func cmdResetLimits(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one key")
+	}
+	keyPath, err := cleanKeyPath(args[0])
+	if err != nil {
+		return err
+	}
+	return NewLimitTracker(path.Join(*stateDir, "limits")).Reset(keyPath)
+}
+
+// lockTarget parses the target of the lock and unlock commands, returning
+// its kind ("all", "key" or "client"), the key path or client fingerprint,
+// and the remaining arguments.
+func lockTarget(args []string) (string, string, []string, error) {
+	if len(args) == 0 {
+		return "", "", nil, fmt.Errorf("expected all, key or client")
+	}
+	if args[0] == "all" {
+		return "all", "", args[1:], nil
+	}
+	if len(args) < 2 {
+		return "", "", nil, fmt.Errorf("expected %s to lock", args[0])
+	}
+
+	switch args[0] {
+	case "key":
+		keyPath, err := cleanKeyPath(args[1])
+		return "key", keyPath, args[2:], err
+	case "client":
+		fp, err := clientFingerprint(args[1])
+		return "client", fp, args[2:], err
+	default:
+		return "", "", nil, fmt.Errorf("unknown lock kind %q", args[0])
+	}
+}
+
+// clientFingerprint returns the fingerprint of the client certificate,
+// given either directly, or as a file containing the certificate.
+func clientFingerprint(s string) (string, error) {
+	pemData, err := os.ReadFile(s)
+	if os.IsNotExist(err) {
+		return strings.ToLower(strings.TrimPrefix(s, "sha256:")), nil
+	} else if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return "", fmt.Errorf("%s: no certificate found", s)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", s, err)
+	}
+	return certFingerprint(cert), nil
+}
+
+func cmdLock(args []string) error {
+	kind, target, rest, err := lockTarget(args)
+	if err != nil {
+		return err
+	}
+	msg := strings.Join(rest, " ")
+	if msg == "" {
+		return fmt.Errorf("a message is required")
+	}
+
+	ld := NewLockdown(path.Join(*stateDir, "lockdown"))
+	switch kind {
+	case "all":
+		return ld.LockAll(msg)
+	case "key":
+		return ld.LockKey(target, msg)
+	default:
+		return ld.LockClient(target, msg)
+	}
+}
+
+func cmdUnlock(args []string) error {
+	kind, target, rest, err := lockTarget(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("unexpected arguments")
+	}
+
+	ld := NewLockdown(path.Join(*stateDir, "lockdown"))
+	switch kind {
+	case "all":
+		return ld.UnlockAll()
+	case "key":
+		return ld.UnlockKey(target)
+	default:
+		return ld.UnlockClient(target)
+	}
+}
+
+func cmdLocks(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("unexpected arguments")
+	}
+
+	locks, err := NewLockdown(path.Join(*stateDir, "lockdown")).List()
+	if err != nil {
+		return err
+	}
+	for _, lock := range locks {
+		fmt.Println(lock)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+var notifyDenials = flag.Bool(
+	"notify_denials", false,
+	"Send notifications when access to a key is denied")
+var denialNotifyInterval = flag.Duration(
+	"denial_notify_interval", 10*time.Minute,
+	"Minimum time between denial notifications for the same source and key")
+
+// denialLimiter rate-limits the denial notifications, so a misbehaving
+// client (or a scanner) can't flood the recipients.
+type denialLimiter struct {
+	mu sync.Mutex
+
+	// Last notification for each source and key, and how many were
+	// suppressed since then.
+	records map[string]*denialRecord
+
+	// Last time we cleaned up the expired records.
+	lastCleanup time.Time
+}
+
+type denialRecord struct {
+	notified   time.Time
+	suppressed int
+}
+
+var denials = &denialLimiter{records: map[string]*denialRecord{}}
+
+// Allow returns whether a denial from the given source on the key should be
+// notified, and if so, how many denials were suppressed since the last
+// notification.
+func (l *denialLimiter) Allow(source, key string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	interval := *denialNotifyInterval
+	if now.Sub(l.lastCleanup) > interval {
+		for k, r := range l.records {
+			if now.Sub(r.notified) > interval {
+				delete(l.records, k)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	id := source + " " + key
+	r, ok := l.records[id]
+	if ok && now.Sub(r.notified) < interval {
+		r.suppressed++
+		return false, 0
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = r.suppressed
+	}
+	l.records[id] = &denialRecord{notified: now}
+	return true, suppressed
+}
+
+// denied records a denied request, so misbehaving sources get banned, and
+// notifies about it. kc is nil if the request was not for an existing key,
+// in which case there is nobody to notify.
+func denied(kc *KeyConfig, req *Request, reason string) {
+	for _, ban := range bans.Record(requestSources(req), reason, time.Now()) {
+		req.Printf("Banned: %s", ban)
+		alertBan(ban, req)
+	}
+
+	if kc != nil {
+		keyDenied(kc, req, reason, false)
+	}
+}
+
+// keyDenied records a denied request on an existing key, and notifies about
+// it if enabled with --notify_denials, or if always is true.
+func keyDenied(kc *KeyConfig, req *Request, reason string, always bool) {
+	if keyPath, err := req.KeyPath(); err == nil {
+		accessTracker.RecordDenial(keyPath, req, reason)
+	}
+
+	if *notifyDenials || always {
+		queueDenialNotification(kc, req, reason)
+	}
+}
+
+// queueDenialNotification queues the notifications for a denied request on
+// the given key. They are always queued, as there is no point in holding the
+// (already failed) request for them.
+func queueDenialNotification(kc *KeyConfig, req *Request, reason string) {
+	source, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		source = req.RemoteAddr
+	}
+
+	ev, err := NewEvent(EventKeyDenied, req,
+		[][]*x509.Certificate{req.TLS.PeerCertificates})
+	if err != nil {
+		req.Printf("Error notifying denial: %s", err)
+		return
+	}
+
+	ok, suppressed := denials.Allow(source, ev.Key, ev.Time)
+	if !ok {
+		req.Printf("Not notifying denial, too many recent ones")
+		return
+	}
+	ev.Reason = reason
+	ev.Suppressed = suppressed
+
+	ds, err := composeNotifications(kc, ev)
+	if err != nil {
+		req.Printf("Error notifying denial: %s", err)
+		return
+	}
+	for _, d := range ds {
+		req.Printf("Queueing denial notification: %s", d)
+		if err := notifySpool.Add(d); err != nil {
+			req.Printf("Error queueing denial notification: %s", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDenialLimiter(t *testing.T) {
+	l := &denialLimiter{records: map[string]*denialRecord{}}
+	now := time.Now()
+	interval := *denialNotifyInterval
+
+	check := func(source, key string, when time.Time,
+		expOK bool, expSuppressed int) {
+		t.Helper()
+		ok, suppressed := l.Allow(source, key, when)
+		if ok != expOK || suppressed != expSuppressed {
+			t.Errorf("Allow(%q, %q) = %v, %d; expected %v, %d",
+				source, key, ok, suppressed, expOK, expSuppressed)
+		}
+	}
+
+	check("192.0.2.1", "key", now, true, 0)
+	check("192.0.2.1", "key", now.Add(time.Second), false, 0)
+	check("192.0.2.1", "key", now.Add(2*time.Second), false, 0)
+
+	// Different sources and keys are independent.
+	check("192.0.2.2", "key", now, true, 0)
+	check("192.0.2.1", "other", now, true, 0)
+
+	// Once the interval passes, we get notified again, along with how many
+	// were suppressed.
+	check("192.0.2.1", "key", now.Add(interval), true, 2)
+	check("192.0.2.1", "key", now.Add(interval+time.Second), false, 0)
+
+	// Old records get cleaned up.
+	check("192.0.2.3", "key", now.Add(3*interval), true, 0)
+	if len(l.records) != 1 {
+		t.Errorf("expected 1 record after cleanup, got %d: %v",
+			len(l.records), l.records)
+	}
+}
+
+func TestNotifyDenial(t *testing.T) {
+	stub := &webhookStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	oldSpool := notifySpool
+	notifySpool = NewSpool(t.TempDir())
+	defer func() { notifySpool = oldSpool }()
+
+	oldDenials := denials
+	denials = &denialLimiter{records: map[string]*denialRecord{}}
+	defer func() { denials = oldDenials }()
+
+	store := NewMemStore()
+	store.Set("key", "webhooks", []byte(srv.URL+"\n"))
+	kc := NewKeyConfig(store, "key")
+
+	cert := newTestCert(t, "client").Leaf
+	req := newTestRequest("key", "192.0.2.1:1234")
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	// Disabled by default.
+	keyDenied(kc, req, "Host not allowed", false)
+	if depth, _ := notifySpool.Stats(); depth != 0 {
+		t.Fatalf("denial notified while disabled")
+	}
+
+	*notifyDenials = true
+	defer func() { *notifyDenials = false }()
+
+	// Even if the key's policy is to notify before the release, denials
+	// are always queued.
+	keyDenied(kc, req, "Host not allowed", false)
+	keyDenied(kc, req, "Host not allowed", false)
+	if depth, _ := notifySpool.Stats(); depth != 1 {
+		t.Fatalf("expected 1 queued notification, got %d", depth)
+	}
+
+	notifySpool.Process()
+	if len(stub.payloads) != 1 {
+		t.Fatalf("expected 1 payload, got %d", len(stub.payloads))
+	}
+	p := stub.payloads[0]
+	if p.Event != EventKeyDenied || p.Reason != "Host not allowed" ||
+		p.Client.Fingerprint != certFingerprint(cert) ||
+		len(p.Chains) != 1 {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
+)
+
+var masterSecretFile = flag.String(
+	"master_secret_file", "",
+	"File with the master secret to derive keys from "+
+		"(derived keys are disabled if empty)")
+
+// Minimum length of the master secret, in bytes.
+const minMasterSecretLen = 32
+
+// Defaults for the derivation parameters.
+const (
+	defaultDeriveVersion = 1
+	defaultDeriveLength  = 32
+)
+
+// Maximum length of a derived key, as per RFC 5869.
+const maxDeriveLength = 255 * sha256.Size
+
+// deriveParams are the parameters to derive a key, from a "derive" file.
+type deriveParams struct {
+	// Version of the key; increment it to rotate the key.
+	Version int
+
+	// Length of the key, in bytes.
+	Length int
+}
+
+// parseDeriveParams parses the contents of a "derive" file, with lines
+// like "version 2" or "length 64". An empty file uses the defaults.
+func parseDeriveParams(contents string) (*deriveParams, error) {
+	p := &deriveParams{
+		Version: defaultDeriveVersion,
+		Length:  defaultDeriveLength,
+	}
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in %q", line)
+		}
+
+		switch fields[0] {
+		case "version":
+			if n < 0 {
+				return nil, fmt.Errorf("invalid version %d", n)
+			}
+			p.Version = n
+		case "length":
+			if n < 1 || n > maxDeriveLength {
+				return nil, fmt.Errorf("invalid length %d (must be "+
+					"between 1 and %d)", n, maxDeriveLength)
+			}
+			p.Length = n
+		default:
+			return nil, fmt.Errorf("unknown setting %q", fields[0])
+		}
+	}
+	return p, nil
+}
+
+// loadMasterSecret loads the master secret from the given file.
+func loadMasterSecret(path string) ([]byte, error) {
+	secret, err := keymem.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minMasterSecretLen {
+		keymem.Wipe(secret)
+		return nil, fmt.Errorf("master secret too short (%d bytes, "+
+			"must be at least %d)", len(secret), minMasterSecretLen)
+	}
+	return secret, nil
+}
+
+// deriveKey derives the key with the given path and parameters from the
+// master secret, using HKDF-SHA256 (RFC 5869).
+//
+// The key path and version go in the HKDF info, so each key (and each
+// version of it) is independent of the others.
+func deriveKey(secret []byte, keyPath string, p *deriveParams) []byte {
+	info := fmt.Sprintf("kxd derived key\x00%s\x00%d", keyPath, p.Version)
+	return hkdfSHA256(secret, nil, []byte(info), p.Length)
+}
+
+// hkdfSHA256 implements HKDF (RFC 5869) with SHA-256.
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	// Extract.
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	prk := mac.Sum(nil)
+	defer clear(prk)
+
+	// Expand. The output goes in a buffer with room for the last block,
+	// so it doesn't grow.
+	out := keymem.Alloc(length + sha256.Size)[:0]
+	prev := []byte{}
+	for i := byte(1); len(out) < length; i++ {
+		mac = hmac.New(sha256.New, prk)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		clear(prev)
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	clear(prev)
+	return out[:length]
+}
+
+// findDerive looks for the "derive" file that applies to the given key: the
+// one in its directory, or else the closest one in its parents (up to, and
+// including, the root of the store). It returns its path, or "" if there is
+// none.
+func (s *DirStore) findDerive(keyPath string) (string, error) {
+	dir := keyPath
+	for {
+		path := s.path(dir, "derive")
+		isRegular, err := isRegular(path)
+		if err == nil && isRegular {
+			return path, nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		if dir == "" {
+			return "", nil
+		}
+		dir = filepath.ToSlash(filepath.Dir(dir))
+		if dir == "." {
+			dir = ""
+		}
+	}
+}
+
+// readDerivedKey derives the key from the master secret, using the
+// parameters in the given "derive" file.
+func (s *DirStore) readDerivedKey(keyPath, derivePath string) ([]byte, error) {
+	if s.MasterSecret == nil {
+		return nil, fmt.Errorf("%s: derived key, but there is no master "+
+			"secret (see --master_secret_file)", keyPath)
+	}
+
+	p, err := readDeriveParams(derivePath)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(s.MasterSecret, keyPath, p), nil
+}
+
+// readDeriveParams reads and parses the given "derive" file.
+func readDeriveParams(path string) (*deriveParams, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseDeriveParams(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
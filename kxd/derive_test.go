@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestHKDF(t *testing.T) {
+	// Test cases 1 to 3 from RFC 5869, appendix A.
+	seq := func(from, to int) []byte {
+		b := []byte{}
+		for c := from; c <= to; c++ {
+			b = append(b, byte(c))
+		}
+		return b
+	}
+	cases := []struct {
+		ikm, salt, info []byte
+		length          int
+		okm             string
+	}{
+		{
+			bytes.Repeat([]byte{0x0b}, 22), seq(0x00, 0x0c),
+			seq(0xf0, 0xf9), 42,
+			"3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56" +
+				"ecc4c5bf34007208d5b887185865",
+		},
+		{
+			seq(0x00, 0x4f), seq(0x60, 0xaf), seq(0xb0, 0xff), 82,
+			"b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c" +
+				"19afa97c59045a99cac7827271cb41c65e590e09da3275600c2f" +
+				"09b8367793a9aca3db71cc30c58179ec3e87c14c01d5c1f3434f" +
+				"1d87",
+		},
+		{
+			bytes.Repeat([]byte{0x0b}, 22), nil, nil, 42,
+			"8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f" +
+				"3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+	for i, c := range cases {
+		okm := hkdfSHA256(c.ikm, c.salt, c.info, c.length)
+		if got := hex.EncodeToString(okm); got != c.okm {
+			t.Errorf("case %d: hkdfSHA256 = %s, expected %s",
+				i+1, got, c.okm)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	secret := []byte(strings.Repeat("s", minMasterSecretLen))
+
+	// Fixed vector, so any change to how keys are derived is noticed:
+	// that would change every derived key out there.
+	k := deriveKey(secret, "host/k1", &deriveParams{Version: 1, Length: 32})
+	expected := "2945f9160cda29de9806cfca9d78c6561073e1449281ee4f14c2c532" +
+		"c378011b"
+	if got := hex.EncodeToString(k); got != expected {
+		t.Errorf("deriveKey = %s, expected %s", got, expected)
+	}
+
+	// The key path and version go in the info, separated by NULs, and the
+	// secret is used without a salt.
+	cases := []struct {
+		keyPath string
+		p       deriveParams
+		info    string
+	}{
+		{"host/k1", deriveParams{1, 32}, "kxd derived key\x00host/k1\x001"},
+		{"host/k1", deriveParams{12, 48}, "kxd derived key\x00host/k1\x0012"},
+		{"a/b/c", deriveParams{0, 16}, "kxd derived key\x00a/b/c\x000"},
+	}
+	for _, c := range cases {
+		k := deriveKey(secret, c.keyPath, &c.p)
+		exp := hkdfSHA256(secret, nil, []byte(c.info), c.p.Length)
+		if !bytes.Equal(k, exp) {
+			t.Errorf("deriveKey(%q, %v) = %x, expected %x",
+				c.keyPath, c.p, k, exp)
+		}
+		if len(k) != c.p.Length {
+			t.Errorf("deriveKey(%q, %v): got %d bytes",
+				c.keyPath, c.p, len(k))
+		}
+	}
+
+	// The length only truncates the output: the version is what rotates
+	// the key.
+	short := deriveKey(secret, "host/k1", &deriveParams{1, 16})
+	long := deriveKey(secret, "host/k1", &deriveParams{1, 64})
+	if !bytes.Equal(short, long[:16]) || !bytes.Equal(k, long[:32]) {
+		t.Errorf("keys of different lengths aren't prefixes: %x %x %x",
+			short, k, long)
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte(strings.Repeat("s", minMasterSecretLen))
+	s := NewDirStore(dir)
+	s.MasterSecret = secret
+
+	// Whole subtree, with one key overriding the version, one stored key,
+	// and one per-key derivation outside of it.
+	writeFile(t, dir+"/host/derive", "# Comment.\n")
+	writeFile(t, dir+"/host/k1/allowed_clients", "")
+	writeFile(t, dir+"/host/k2/derive", "version 2\nlength 64\n")
+	writeFile(t, dir+"/host/k3/key", "stored")
+	writeFile(t, dir+"/other/k4/derive", "")
+	writeFile(t, dir+"/other/k5/allowed_clients", "")
+
+	keys, _ := s.Keys()
+	if got := strings.Join(keys, " "); got != "host host/k1 host/k2 "+
+		"host/k3 other/k4" {
+		t.Errorf("Keys = %v", keys)
+	}
+
+	read := func(keyPath string) []byte {
+		t.Helper()
+		key, err := s.ReadKey(keyPath)
+		if err != nil {
+			t.Fatalf("ReadKey(%q): %v", keyPath, err)
+		}
+		return key
+	}
+
+	k1 := read("host/k1")
+	if !bytes.Equal(k1, deriveKey(secret, "host/k1",
+		&deriveParams{Version: 1, Length: 32})) {
+		t.Errorf("host/k1 = %x, not derived with the defaults", k1)
+	}
+	if k := read("host/k2"); len(k) != 64 || bytes.Equal(k[:32], k1) {
+		t.Errorf("host/k2 = %x, expected 64 bytes different from k1", k)
+	}
+	if k := read("host/k3"); string(k) != "stored" {
+		t.Errorf("host/k3 = %q, expected the stored key", k)
+	}
+	if k := read("other/k4"); bytes.Equal(k, k1) || len(k) != 32 {
+		t.Errorf("other/k4 = %x, expected different from k1", k)
+	}
+
+	// Different versions and secrets give different keys.
+	p := &deriveParams{Version: 1, Length: 32}
+	if bytes.Equal(deriveKey(secret, "k", p),
+		deriveKey(append(secret, 'x'), "k", p)) {
+		t.Errorf("same key with different secrets")
+	}
+	if bytes.Equal(deriveKey(secret, "k", p),
+		deriveKey(secret, "k", &deriveParams{Version: 2, Length: 32})) {
+		t.Errorf("same key with different versions")
+	}
+
+	// Without a master secret, derived keys can't be read.
+	s.MasterSecret = nil
+	if _, err := s.ReadKey("host/k1"); err == nil {
+		t.Errorf("derived key read without a master secret")
+	}
+}
+
+func TestDeriveParamsErrors(t *testing.T) {
+	invalid := []string{
+		"version",
+		"version -1",
+		"version x",
+		"length 0",
+		"length 100000",
+		"unknown 1",
+	}
+	for _, contents := range invalid {
+		if _, err := parseDeriveParams(contents); err == nil {
+			t.Errorf("%q: parsed without errors", contents)
+		}
+	}
+}
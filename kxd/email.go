@@ -2,15 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/x509"
-	"net/smtp"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
-	"text/template"
 	"time"
 )
 
-// EmailBody represents the body of an email message to sent.
+// EmailBody represents the body of an email message to sent. It is what the
+// email templates get as data.
 type EmailBody struct {
+	Event      string
 	From       string
 	To         string
 	Key        string
@@ -19,78 +28,260 @@ type EmailBody struct {
 	Req        *Request
 	Cert       *x509.Certificate
 	Chains     [][]*x509.Certificate
-}
 
-const emailTmplBody = (`Date: {{.TimeString}}
-From: Key Exchange Daemon <{{.From}}>
-To: {{.To}}
-Subject: Access to key {{.Key}}
+	// Key metadata, from the key's labels file.
+	KeyLabels map[string]string
 
-Key: {{.Key}}
-Accessed by: {{.Req.RemoteAddr}}
-On: {{.TimeString}}
+	// Attributes of the client certificate's subject (e.g. "CN", "O"), and
+	// its SHA-256 fingerprint.
+	ClientLabels      map[string]string
+	ClientFingerprint string
 
-Client certificate:
-  Signature: {{printf "%.16s" (printf "%x" .Cert.Signature)}}...
-  Subject: {{.Cert.Subject}}
+	// Information about the network address of the client.
+	Network NetworkInfo
 
-Authorizing chains:
-{{range .Chains}}  {{ChainToString .}}
-{{end}}
+	// For denials, the reason, and how many other denials from the same
+	// source were not notified since the last notification.
+	Reason     string
+	Suppressed int
+}
 
-`)
+// NetworkInfo holds information about the network address of a client.
+type NetworkInfo struct {
+	IP       string
+	Port     string
+	Loopback bool
+	Private  bool
 
-var emailTmpl = template.New("email")
+	// Names from reverse DNS lookup of the IP, if any.
+	ReverseNames []string
+}
 
-func init() {
-	emailTmpl.Funcs(map[string]interface{}{
-		"ChainToString": ChainToString,
-	})
+// Timeout for the reverse DNS lookup of the client's address, and how long
+// composing a notification waits for it before giving up on the names.
+const (
+	reverseLookupTimeout = 2 * time.Second
+	reverseLookupWait    = 100 * time.Millisecond
+)
 
-	template.Must(emailTmpl.Parse(emailTmplBody))
+// reverseLookup is a reverse DNS lookup of a client's IP address. It runs in
+// the background from the start of the request, so it does not delay giving
+// out the key.
+type reverseLookup struct {
+	done  chan struct{}
+	names []string
 }
 
-// SendMail sends an email notifying of an access to the given key.
-func SendMail(kc *KeyConfig, req *Request,
-	chains [][]*x509.Certificate) error {
-	if *smtpAddr == "" {
-		req.Printf("Skipping notifications")
+func startReverseLookup(ip string) *reverseLookup {
+	rl := &reverseLookup{done: make(chan struct{})}
+	go func() {
+		defer close(rl.done)
+		ctx, cancel := context.WithTimeout(context.Background(),
+			reverseLookupTimeout)
+		defer cancel()
+		rl.names, _ = net.DefaultResolver.LookupAddr(ctx, ip)
+	}()
+	return rl
+}
+
+// Names returns the result of the lookup, or nil if it hasn't finished
+// within a short wait.
+func (rl *reverseLookup) Names() []string {
+	select {
+	case <-rl.done:
+		return rl.names
+	case <-time.After(reverseLookupWait):
 		return nil
 	}
+}
+
+func newNetworkInfo(req *Request) NetworkInfo {
+	ni := NetworkInfo{}
+	ni.IP, ni.Port, _ = net.SplitHostPort(req.RemoteAddr)
+
+	ip := net.ParseIP(ni.IP)
+	if ip == nil {
+		return ni
+	}
+	ni.Loopback = ip.IsLoopback()
+	ni.Private = ip.IsPrivate()
+
+	if req.reverse != nil {
+		ni.ReverseNames = req.reverse.Names()
+	}
+
+	return ni
+}
+
+// subjectLabels returns the most common attributes of the given subject, by
+// their usual short names.
+func subjectLabels(n pkix.Name) map[string]string {
+	labels := map[string]string{}
+	add := func(k string, vs []string) {
+		if len(vs) > 0 {
+			labels[k] = strings.Join(vs, ", ")
+		}
+	}
+	if n.CommonName != "" {
+		labels["CN"] = n.CommonName
+	}
+	add("O", n.Organization)
+	add("OU", n.OrganizationalUnit)
+	add("L", n.Locality)
+	add("ST", n.Province)
+	add("C", n.Country)
+	if n.SerialNumber != "" {
+		labels["SERIALNUMBER"] = n.SerialNumber
+	}
+	return labels
+}
+
+// composeMail composes the email notifying of the event on the given key.
+// Returns nil if there is nobody to notify.
+func composeMail(kc *KeyConfig, ev *Event) (*delivery, error) {
+	if !mailEnabled() {
+		ev.Req.Printf("Skipping email notifications")
+		return nil, nil
+	}
 
 	emailTo, err := kc.EmailTo()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if emailTo == nil {
-		return nil
+		return nil, nil
 	}
 
-	keyPath, err := req.KeyPath()
+	keyLabels, err := kc.Labels()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	now := time.Now()
 	body := EmailBody{
-		From:       *emailFrom,
-		To:         strings.Join(emailTo, ", "),
-		Key:        keyPath,
-		Time:       now,
-		TimeString: now.Format(time.RFC1123Z),
-		Req:        req,
-		Cert:       chains[0][0],
-		Chains:     chains,
+		Event:             ev.Type,
+		From:              *emailFrom,
+		To:                strings.Join(emailTo, ", "),
+		Key:               ev.Key,
+		Time:              ev.Time,
+		TimeString:        ev.Time.Format(time.RFC1123Z),
+		Req:               ev.Req,
+		Cert:              ev.Cert,
+		Chains:            ev.Chains,
+		KeyLabels:         keyLabels,
+		ClientLabels:      subjectLabels(ev.Cert.Subject),
+		ClientFingerprint: certFingerprint(ev.Cert),
+		Network:           newNetworkInfo(ev.Req),
+		Reason:            ev.Reason,
+		Suppressed:        ev.Suppressed,
+	}
+
+	msg, err := templatesFor(ev.Key).Render(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery{
+		Kind: "email",
+		From: *emailFrom,
+		To:   emailTo,
+		Data: msg,
+	}, nil
+}
+
+// Render the email message (headers and body) for the given data.
+//
+// If there is an HTML template, the message is a multipart/alternative with
+// both the text and HTML versions; otherwise it's just plain text.
+func (et *emailTemplates) Render(body EmailBody) ([]byte, error) {
+	text := new(bytes.Buffer)
+	err := et.text.Execute(text, body)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	err = et.text.ExecuteTemplate(subject, "subject", body)
+	if err != nil {
+		return nil, err
 	}
 
 	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "Date: %s\n", body.TimeString)
+	fmt.Fprintf(msg, "From: Key Exchange Daemon <%s>\n", body.From)
+	fmt.Fprintf(msg, "To: %s\n", body.To)
+	fmt.Fprintf(msg, "Subject: %s\n", headerValue(subject.String()))
 
-	err = emailTmpl.Execute(msg, body)
+	if et.html == nil {
+		msg.WriteString("\n")
+		msg.Write(text.Bytes())
+		return msg.Bytes(), nil
+	}
+
+	html := new(bytes.Buffer)
+	err = et.html.Execute(html, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return smtp.SendMail(*smtpAddr, nil, *emailFrom, emailTo,
-		msg.Bytes())
+	boundary := randomBoundary()
+	fmt.Fprintf(msg, "MIME-Version: 1.0\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; "+
+		"boundary=%q\n\n", boundary)
+	writeMIMEPart(msg, boundary, "text/plain", text.Bytes())
+	writeMIMEPart(msg, boundary, "text/html", html.Bytes())
+	fmt.Fprintf(msg, "--%s--\n", boundary)
+
+	return msg.Bytes(), nil
+}
+
+// headerValue makes the string safe for using as a header value.
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func randomBoundary() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return "kxd-" + hex.EncodeToString(buf)
+}
+
+func writeMIMEPart(msg *bytes.Buffer, boundary, ctype string, data []byte) {
+	fmt.Fprintf(msg, "--%s\n", boundary)
+	fmt.Fprintf(msg, "Content-Type: %s; charset=utf-8\n", ctype)
+	fmt.Fprintf(msg, "Content-Transfer-Encoding: quoted-printable\n\n")
+	w := quotedprintable.NewWriter(msg)
+	w.Write(data)
+	w.Close()
+	msg.WriteString("\n")
+}
+
+// sampleEmailBody returns an EmailBody with some dummy data, used to check
+// templates can be executed.
+func sampleEmailBody() EmailBody {
+	cert := &x509.Certificate{
+		Signature: []byte("signature"),
+		Subject:   pkix.Name{CommonName: "client"},
+	}
+	u, _ := url.Parse("/v1/host/key")
+	req := &Request{
+		Request: &http.Request{URL: u, RemoteAddr: "192.0.2.1:1234"},
+		ID:      "0123456789abcdef",
+	}
+	now := time.Now()
+	return EmailBody{
+		Event:             EventKeyGranted,
+		From:              "kxd@example.com",
+		To:                "someone@example.com",
+		Key:               "host/key",
+		Time:              now,
+		TimeString:        now.Format(time.RFC1123Z),
+		Req:               req,
+		Cert:              cert,
+		Chains:            [][]*x509.Certificate{{cert}},
+		KeyLabels:         map[string]string{"label": "value"},
+		ClientLabels:      subjectLabels(cert.Subject),
+		ClientFingerprint: certFingerprint(cert),
+		Network:           NetworkInfo{IP: "192.0.2.1", Port: "1234"},
+	}
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// cmdExplain prints the configuration in effect for a key, and whether it
+// can be accessed right now, to help understand why requests for it are (or
+// aren't) allowed.
+func cmdExplain(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one key")
+	}
+	keyPath, err := cleanKeyPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	store := NewDirStore(*dataDir)
+	kc := NewKeyConfig(store, keyPath)
+	exists, err := kc.Exists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("key %q not found in %s", keyPath, store)
+	}
+
+	now := time.Now()
+	item := func(name string, value interface{}) {
+		if name != "" {
+			name += ":"
+		}
+		fmt.Printf("%-21s %v\n", name, value)
+	}
+	list := func(name string, values []string, empty string) {
+		if len(values) == 0 {
+			item(name, empty)
+			return
+		}
+		item(name, values[0])
+		for _, v := range values[1:] {
+			item("", v)
+		}
+	}
+
+	item("Key", keyPath)
+	item("Store", store)
+
+	files := []string{}
+	for _, name := range policyFiles {
+		if _, origin, err := lookupFile(store, keyPath, name); err == nil {
+			files = append(files, fmt.Sprintf("%s (%s)",
+				name, originString(keyPath, origin)))
+		}
+	}
+	list("Policy files", files, "none")
+
+	ld := NewLockdown(path.Join(*stateDir, "lockdown"))
+	if lock, err := ld.Check(keyPath, nil); err != nil {
+		item("Lock", "error: "+err.Error())
+	} else if lock != nil {
+		item("Lock", lock)
+	} else {
+		item("Lock", "none")
+	}
+
+	contents, err := kc.readFile("allowed_clients")
+	clients, err := explainClients(store, contents, err)
+	if err != nil {
+		item("Allowed clients", "error: "+err.Error())
+	} else {
+		list("Allowed clients", clients, "none")
+	}
+
+	hosts, err := readLines(kc.readFile("allowed_hosts"))
+	if os.IsNotExist(err) {
+		item("Allowed hosts", "any")
+	} else if err != nil {
+		item("Allowed hosts", "error: "+err.Error())
+	} else {
+		list("Allowed hosts", hosts, "none")
+	}
+
+	if mode, err := kc.BindClientIP(); err != nil {
+		item("Client IP binding", "error: "+err.Error())
+	} else if mode == "" {
+		item("Client IP binding", "none")
+	} else {
+		item("Client IP binding", mode)
+	}
+
+	if policy, err := kc.NotifyPolicy(); err != nil {
+		item("Notification policy", "error: "+err.Error())
+	} else {
+		item("Notification policy", policy)
+	}
+
+	emailTo, _ := kc.EmailTo()
+	list("Email to", emailTo, "nobody")
+
+	webhooks, _ := kc.Webhooks()
+	list("Webhooks", append(append([]string{}, webhookURLs...),
+		webhooks...), "none")
+
+	limits, err := kc.Limits()
+	if err != nil {
+		item("Limits", "error: "+err.Error())
+	} else if limits == nil {
+		item("Limits", "none")
+	} else {
+		item("Limits", limits)
+		lt := NewLimitTracker(path.Join(*stateDir, "limits"))
+		if uses, err := lt.Uses(keyPath); err == nil {
+			item("", fmt.Sprintf("accessed %d times so far", uses))
+		}
+	}
+
+	tracker := NewAccessTracker(path.Join(*stateDir, "access"))
+	if ka, err := tracker.Load(keyPath); err != nil {
+		item("Accesses", "error: "+err.Error())
+	} else {
+		item("Accesses", ka.Accesses)
+		if r := ka.LastAccess; r != nil {
+			item("Last access", fmt.Sprintf("%s by %s from %s",
+				r.Time.Format(time.RFC1123Z), r.Client, r.IP))
+		}
+		if ka.MetaAccesses > 0 {
+			item("Metadata requests", ka.MetaAccesses)
+		}
+		item("Denials", ka.Denials)
+		if r := ka.LastDenial; r != nil {
+			item("Last denial", fmt.Sprintf("%s from %s: %s",
+				r.Time.Format(time.RFC1123Z), r.IP, r.Reason))
+		}
+	}
+
+	schedule, err := kc.Schedule()
+	if err != nil {
+		item("Schedule", "error: "+err.Error())
+	} else if schedule == nil {
+		item("Schedule", "none (always open)")
+	} else {
+		explainSchedule(schedule, now, item)
+	}
+
+	return nil
+}
+
+func explainSchedule(s *Schedule, now time.Time,
+	item func(string, interface{})) {
+	item("Schedule", "timezone "+s.Location.String())
+	if !s.NotBefore.IsZero() {
+		item("", "not before "+s.NotBefore.Format(time.RFC3339))
+	}
+	if !s.NotAfter.IsZero() {
+		item("", "not after "+s.NotAfter.Format(time.RFC3339))
+	}
+	for _, w := range s.Windows {
+		item("", "window "+w.String())
+	}
+
+	if err := s.Check(now); err != nil {
+		item("Schedule now", "closed: "+err.Error())
+	} else if w := s.ActiveWindow(now); w != nil {
+		item("Schedule now", "open, in window "+w.String())
+	} else {
+		item("Schedule now", "open")
+	}
+
+	if next, ok := s.NextOpen(now); !ok {
+		item("Next opening", "never")
+	} else if next.After(now) {
+		item("Next opening", next.Format(time.RFC1123Z))
+	}
+}
+
+// explainClients returns a description of each of the clients in the given
+// allowed_clients file contents (as returned by KeyConfig.readFile),
+// including the ones in the groups it references.
+func explainClients(store Store, contents []byte, err error) (
+	[]string, error) {
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cl, err := parseClientList(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []string{}
+	err = resolveClients(store, cl, nil,
+		func(cl *clientList, stack []string) {
+			prefix := ""
+			if len(stack) > 0 {
+				prefix = "@" + strings.Join(stack, " > @") + ": "
+			}
+			for _, cert := range cl.certs {
+				clients = append(clients, fmt.Sprintf(
+					"%s%s (sha256 %s)", prefix, cert.Subject,
+					certFingerprint(cert)))
+			}
+			for _, fp := range cl.fingerprints {
+				clients = append(clients, fmt.Sprintf(
+					"%ssha256 %s", prefix, fp))
+			}
+		})
+	return clients, err
+}
+
+// readLines returns the non-empty lines of the given file contents (as
+// returned by KeyConfig.readFile).
+func readLines(contents []byte, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Client groups are kept in the "_groups" directory of the store (e.g.
+// "_groups/db-servers"), with the same format as the allowed_clients files.
+// They are referenced from those files (or from other groups) as
+// "@db-servers".
+//
+// Note "_groups" is never a key, so the groups can't be requested.
+const groupsDir = "_groups"
+
+// isGroupsPath returns whether the given key path is within the groups
+// directory.
+func isGroupsPath(keyPath string) bool {
+	return keyPath == groupsDir || strings.HasPrefix(keyPath, groupsDir+"/")
+}
+
+var validGroupName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// parseFingerprint parses a "sha256:<hex>" certificate fingerprint, as
+// found in allowed_clients files. The hex digits can be in either case, and
+// be separated by colons (like openssl prints them). It returns the
+// fingerprint in the same form as certFingerprint.
+func parseFingerprint(s string) (string, error) {
+	fp, ok := strings.CutPrefix(s, "sha256:")
+	if !ok {
+		return "", fmt.Errorf("invalid fingerprint %q, expected "+
+			"sha256:<hex>", s)
+	}
+	fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+	return fp, checkFingerprint(fp)
+}
+
+// clientList is the parsed contents of an allowed_clients (or group) file.
+type clientList struct {
+	certs        []*x509.Certificate
+	fingerprints []string
+	groups       []string
+}
+
+func (cl *clientList) empty() bool {
+	return len(cl.certs)+len(cl.fingerprints)+len(cl.groups) == 0
+}
+
+// parseClientList parses the contents of an allowed_clients (or group)
+// file, which can contain PEM-encoded certificates, "sha256:<hex>"
+// fingerprint lines, and "@<group>" lines. Anything else is ignored (for
+// example, the text openssl puts before the certificates).
+//
+// Like x509.CertPool.AppendCertsFromPEM (which was used before groups and
+// fingerprints were supported), PEM blocks that are not certificates, or
+// that can't be parsed, are skipped; they are only logged. Only invalid
+// group and fingerprint lines are errors.
+func parseClientList(contents []byte) (*clientList, error) {
+	cl := &clientList{}
+	rest := contents
+	for len(rest) > 0 {
+		// Take the text up to the next PEM block (if any), and parse it
+		// line by line.
+		var text []byte
+		if i := bytes.Index(rest, []byte("-----BEGIN ")); i >= 0 {
+			text, rest = rest[:i], rest[i:]
+		} else {
+			text, rest = rest, nil
+		}
+
+		for _, line := range strings.Split(string(text), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "@") {
+				name := line[1:]
+				if !validGroupName.MatchString(name) {
+					return nil, fmt.Errorf("invalid group name %q", name)
+				}
+				cl.groups = append(cl.groups, name)
+			} else if strings.HasPrefix(line, "sha256:") {
+				fp, err := parseFingerprint(line)
+				if err != nil {
+					return nil, err
+				}
+				cl.fingerprints = append(cl.fingerprints, fp)
+			}
+		}
+
+		if len(rest) == 0 {
+			break
+		}
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			// Skip the broken block's header, and keep looking at the
+			// rest as text.
+			logging.Printf("Ignoring invalid PEM block in client list")
+			rest = rest[len("-----BEGIN "):]
+			continue
+		}
+		if block.Type != "CERTIFICATE" {
+			logging.Printf("Ignoring %q PEM block in client list",
+				block.Type)
+			continue
+		}
+		if len(block.Headers) != 0 {
+			logging.Printf("Ignoring certificate with PEM headers in " +
+				"client list")
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			logging.Printf("Ignoring invalid certificate in client "+
+				"list: %v", err)
+			continue
+		}
+		cl.certs = append(cl.certs, cert)
+	}
+	return cl, nil
+}
+
+// readGroup reads and parses the given group.
+func readGroup(store Store, name string) (*clientList, error) {
+	contents, err := store.ReadFile(groupsDir, name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("unknown group @%s", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("group @%s: %v", name, err)
+	}
+	cl, err := parseClientList(contents)
+	if err != nil {
+		return nil, fmt.Errorf("group @%s: %v", name, err)
+	}
+	return cl, nil
+}
+
+// resolveClients calls f for the given client list, and for all the groups
+// it references, recursively. The stack has the groups being resolved, to
+// detect cycles.
+func resolveClients(store Store, cl *clientList, stack []string,
+	f func(cl *clientList, stack []string)) error {
+	f(cl, stack)
+
+	for _, name := range cl.groups {
+		for _, s := range stack {
+			if s == name {
+				return fmt.Errorf("group cycle: @%s -> @%s",
+					strings.Join(stack, " -> @"), name)
+			}
+		}
+
+		group, err := readGroup(store, name)
+		if err != nil {
+			return err
+		}
+		err = resolveClients(store, group, append(stack, name), f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
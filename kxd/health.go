@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var readyzCertMinValidity = flag.Duration(
+	"readyz_cert_min_validity", 7*24*time.Hour,
+	"The server is not ready if its certificate expires within this time")
+
+var readyzDialCacheTTL = flag.Duration(
+	"readyz_dial_cache_ttl", time.Minute,
+	"How long to reuse the result of connecting to the notification "+
+		"backends in /readyz (0 to connect on every check)")
+
+// Timeout for connecting to the notification backends, when checking if
+// they are reachable.
+const readyzDialTimeout = 5 * time.Second
+
+type dialCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// Cache of the results of connecting to the notification backends, by
+// address, so frequent probes don't open connections to them every time.
+// The lock is held while connecting, so concurrent probes wait for the
+// result instead of connecting too.
+var dialCache = struct {
+	sync.Mutex
+	m map[string]dialCacheEntry
+}{m: map[string]dialCacheEntry{}}
+
+// Health and readiness checks, served on the monitoring address so load
+// balancers and monitoring systems can use them without a client
+// certificate.
+//
+// /healthz tells if the server is up. /readyz tells if it can serve keys,
+// by checking the data directory, the server certificate, and the
+// notification backends.
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := []struct {
+		name string
+		f    func() (string, error)
+	}{
+		{"data_dir", checkDataDir},
+		{"server_cert", checkServerCert},
+		{"notifications", checkNotifications},
+	}
+
+	status := http.StatusOK
+	out := ""
+	for _, c := range checks {
+		msg, err := c.f()
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			out += fmt.Sprintf("%s: error: %v\n", c.name, err)
+		} else {
+			out += fmt.Sprintf("%s: ok (%s)\n", c.name, msg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, out)
+}
+
+// checkDataDir checks that the data directory is readable.
+func checkDataDir() (string, error) {
+	dir, err := os.Open(*dataDir)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+
+	_, err = dir.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return "readable", nil
+}
+
+// checkServerCert checks that the server certificate is valid, and that it
+// won't expire soon (see --readyz_cert_min_validity).
+func checkServerCert() (string, error) {
+	contents, err := os.ReadFile(*certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("%s: no PEM certificate found", *certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", *certFile, err)
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return "", fmt.Errorf("not valid until %s", cert.NotBefore)
+	}
+	if now.Add(*readyzCertMinValidity).After(cert.NotAfter) {
+		return "", fmt.Errorf("expires at %s", cert.NotAfter)
+	}
+	return fmt.Sprintf("expires at %s", cert.NotAfter), nil
+}
+
+// checkNotifications checks that the global notification backends are
+// reachable: that we can connect to the SMTP server, or run sendmail, and
+// connect to the webhooks given in --webhook_url. Per-key webhooks are not
+// checked. The results of connecting are cached for a while, see
+// checkReachable.
+func checkNotifications() (string, error) {
+	addrs := []string{}
+	if *sendmailPath != "" {
+		info, err := os.Stat(*sendmailPath)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&0111 == 0 {
+			return "", fmt.Errorf("%s is not executable",
+				*sendmailPath)
+		}
+	} else if *smtpAddr != "" {
+		addrs = append(addrs, *smtpAddr)
+	}
+
+	for _, u := range webhookURLs {
+		addr, err := webhookAddr(u)
+		if err != nil {
+			return "", err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	for _, addr := range addrs {
+		if err := checkReachable(addr); err != nil {
+			return "", err
+		}
+	}
+
+	if *sendmailPath == "" && *smtpAddr == "" && len(webhookURLs) == 0 {
+		return "none configured", nil
+	}
+	return "reachable", nil
+}
+
+// checkReachable checks that we can connect to the given address, reusing
+// recent results (see --readyz_dial_cache_ttl).
+func checkReachable(addr string) error {
+	dialCache.Lock()
+	defer dialCache.Unlock()
+
+	now := time.Now()
+	if e, ok := dialCache.m[addr]; ok && now.Before(e.expires) {
+		return e.err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, readyzDialTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	if *readyzDialCacheTTL > 0 {
+		dialCache.m[addr] = dialCacheEntry{err, now.Add(*readyzDialCacheTTL)}
+	}
+	return err
+}
+
+// webhookAddr returns the host:port to connect to for the given webhook
+// URL.
+func webhookAddr(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "http" {
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "443"), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readyz(t *testing.T) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("healthz = %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir+"/cert.pem", certPEM(newTestCert(t, "server").Leaf))
+
+	smtp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smtp.Close()
+
+	setFlag(t, dataDir, dir)
+	setFlag(t, certFile, dir+"/cert.pem")
+	setFlag(t, smtpAddr, smtp.Addr().String())
+	setFlag(t, sendmailPath, "")
+	setFlag(t, &webhookURLs, stringList{})
+	setFlag(t, readyzDialCacheTTL, time.Minute)
+	setFlag(t, &dialCache.m, map[string]dialCacheEntry{})
+
+	// The test certificate expires in an hour.
+	setFlag(t, readyzCertMinValidity, time.Minute)
+	if code, body := readyz(t); code != http.StatusOK {
+		t.Errorf("readyz = %d %q", code, body)
+	}
+
+	*readyzCertMinValidity = 2 * time.Hour
+	code, body := readyz(t)
+	if code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "server_cert: error: expires at") {
+		t.Errorf("readyz with expiring cert = %d %q", code, body)
+	}
+	*readyzCertMinValidity = time.Minute
+
+	*dataDir = dir + "/missing"
+	code, body = readyz(t)
+	if code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "data_dir: error:") {
+		t.Errorf("readyz with missing data dir = %d %q", code, body)
+	}
+	*dataDir = dir
+
+	// The SMTP server was reachable a moment ago, so it's not checked
+	// again until the cached result expires.
+	smtp.Close()
+	if code, body := readyz(t); code != http.StatusOK {
+		t.Errorf("readyz with SMTP down, cached = %d %q", code, body)
+	}
+
+	dialCache.m = map[string]dialCacheEntry{}
+	code, body = readyz(t)
+	if code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "notifications: error:") {
+		t.Errorf("readyz with SMTP down = %d %q", code, body)
+	}
+
+	// Errors are cached too, and without a TTL nothing is.
+	if len(dialCache.m) != 1 {
+		t.Errorf("failed connection not cached: %v", dialCache.m)
+	}
+	*readyzDialCacheTTL = 0
+	dialCache.m = map[string]dialCacheEntry{}
+	readyz(t)
+	if len(dialCache.m) != 0 {
+		t.Errorf("connection cached without a TTL: %v", dialCache.m)
+	}
+}
+
+func TestWebhookAddr(t *testing.T) {
+	cases := []struct {
+		url, want string
+	}{
+		{"https://example.com/hook", "example.com:443"},
+		{"http://example.com/hook", "example.com:80"},
+		{"https://example.com:8443/hook", "example.com:8443"},
+		{"http://[::1]/hook", "[::1]:80"},
+	}
+	for _, c := range cases {
+		got, err := webhookAddr(c.url)
+		if got != c.want || err != nil {
+			t.Errorf("webhookAddr(%q) = %q, %v, want %q",
+				c.url, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Helpers shared by the tests of the different parts of the package.
+
+// setFlag sets the flag (or any other global) for the duration of the test.
+func setFlag[T any](t *testing.T, f *T, value T) {
+	old := *f
+	*f = value
+	t.Cleanup(func() { *f = old })
+}
+
+// writeFile writes the file, creating its parent directories as needed.
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
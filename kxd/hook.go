@@ -1,15 +1,95 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
+// hookRequest holds the information about a key request that we give to the
+// hook: as environment variables when running it once per request, or as a
+// JSON object when it runs as a co-process.
+type hookRequest struct {
+	RequestID           string   `json:"request_id"`
+	KeyPath             string   `json:"key_path"`
+	RemoteAddr          string   `json:"remote_addr"`
+	MailFrom            string   `json:"mail_from"`
+	EmailTo             []string `json:"email_to,omitempty"`
+	ClientCertSignature string   `json:"client_cert_signature"`
+	ClientCertSubject   string   `json:"client_cert_subject"`
+	Chains              []string `json:"chains"`
+
+	// The request is for the key's metadata, not the key itself.
+	Meta bool `json:"meta,omitempty"`
+}
+
+func newHookRequest(kc *KeyConfig, req *Request,
+	chains [][]*x509.Certificate) (*hookRequest, error) {
+	keyPath, err := req.KeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	clientCert := chains[0][0]
+	hr := &hookRequest{
+		RequestID:  req.ID,
+		KeyPath:    keyPath,
+		RemoteAddr: req.RemoteAddr,
+		MailFrom:   *emailFrom,
+		ClientCertSignature: fmt.Sprintf("%x",
+			clientCert.Signature),
+		ClientCertSubject: clientCert.Subject.String(),
+		Meta:              req.IsMeta(),
+	}
+	if emailTo, _ := kc.EmailTo(); emailTo != nil {
+		hr.EmailTo = emailTo
+	}
+	for _, chain := range chains {
+		hr.Chains = append(hr.Chains, ChainToString(chain))
+	}
+
+	return hr, nil
+}
+
+// baseHookEnv returns the environment variables we copy from our own
+// environment, so the hook has something reasonable to work with.
+func baseHookEnv() []string {
+	env := []string{}
+	for _, v := range strings.Fields("USER PWD SHELL PATH") {
+		env = append(env, v+"="+os.Getenv(v))
+	}
+	return env
+}
+
+// Env returns the environment for running the hook for this request.
+func (hr *hookRequest) Env() []string {
+	env := baseHookEnv()
+	env = append(env, "REQUEST_ID="+hr.RequestID)
+	env = append(env, "KEY_PATH="+hr.KeyPath)
+	env = append(env, "REMOTE_ADDR="+hr.RemoteAddr)
+	env = append(env, "MAIL_FROM="+hr.MailFrom)
+	if hr.EmailTo != nil {
+		env = append(env, "EMAIL_TO="+strings.Join(hr.EmailTo, " "))
+	}
+	env = append(env, "CLIENT_CERT_SIGNATURE="+hr.ClientCertSignature)
+	env = append(env, "CLIENT_CERT_SUBJECT="+hr.ClientCertSubject)
+	for i, chain := range hr.Chains {
+		env = append(env, fmt.Sprintf("CHAIN_%d=%s", i, chain))
+	}
+	if hr.Meta {
+		env = append(env, "META_REQUEST=1")
+	}
+	return env
+}
+
 // RunHook runs the hook, returns an error if the request is not allowed (or
 // there were problems with the hook; we don't make the distinction for now).
 //
@@ -25,51 +105,211 @@ func RunHook(kc *KeyConfig, req *Request, chains [][]*x509.Certificate) error {
 		return nil
 	}
 
+	hr, err := newHookRequest(kc, req, chains)
+	if err != nil {
+		return err
+	}
+
+	if *hookMode == "coprocess" {
+		return hookCoprocess.Ask(hr, *hookTimeout)
+	}
+
 	ctx, cancel := context.WithDeadline(context.Background(),
-		time.Now().Add(1*time.Minute))
+		time.Now().Add(*hookTimeout))
 	defer cancel()
 	cmd := exec.CommandContext(ctx, *hookPath)
 
 	// Run the hook from the data directory.
 	cmd.Dir = *dataDir
+	cmd.Env = hr.Env()
 
-	// Prepare the environment, copying some common variables so the hook has
-	// something reasonable, and then setting the specific ones for this case.
-	for _, v := range strings.Fields("USER PWD SHELL PATH") {
-		cmd.Env = append(cmd.Env, v+"="+os.Getenv(v))
+	_, err = cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("exited with error: %v -- stderr: %q",
+				ee.String(), ee.Stderr)
+		}
+		return err
 	}
 
-	keyPath, err := req.KeyPath()
+	return nil
+}
+
+// hookVerdict is the response of the hook co-process to a request.
+type hookVerdict struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+var errHookTimeout = errors.New("timed out waiting for the hook")
+
+// Coprocess is a long-running hook, which we send requests to via its
+// standard input, and read the verdicts from its standard output, one JSON
+// object per line.
+//
+// The process is started on the first request, and restarted if it exits or
+// misbehaves (e.g. times out or sends an invalid response).
+type Coprocess struct {
+	path string
+
+	// Protects the fields below, and serializes the requests.
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *bufio.Reader
+	exited chan struct{}
+}
+
+// The global hook co-process, only used in "coprocess" hook mode.
+var hookCoprocess *Coprocess
+
+// NewCoprocess returns a new Coprocess for the given hook. The process is
+// not started until the first request.
+func NewCoprocess(path string) *Coprocess {
+	return &Coprocess{path: path}
+}
+
+func (c *Coprocess) start() error {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
 	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
 		return err
 	}
-	cmd.Env = append(cmd.Env, "KEY_PATH="+keyPath)
 
-	cmd.Env = append(cmd.Env, "REMOTE_ADDR="+req.RemoteAddr)
-	cmd.Env = append(cmd.Env, "MAIL_FROM="+*emailFrom)
-	if emailTo, _ := kc.EmailTo(); emailTo != nil {
-		cmd.Env = append(cmd.Env, "EMAIL_TO="+strings.Join(emailTo, " "))
+	cmd := exec.Command(c.path)
+	cmd.Dir = *dataDir
+	cmd.Env = append(baseHookEnv(), "KXD_HOOK_MODE=coprocess")
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = logWriter{"hook: "}
+
+	// Don't wait for stderr to be closed if the process is gone, in case
+	// some of its children are still holding it.
+	cmd.WaitDelay = 1 * time.Second
+
+	err = cmd.Start()
+
+	// The child has its own copies of these now.
+	stdinR.Close()
+	stdoutW.Close()
+
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return err
 	}
 
-	clientCert := chains[0][0]
-	cmd.Env = append(cmd.Env,
-		fmt.Sprintf("CLIENT_CERT_SIGNATURE=%x", clientCert.Signature))
-	cmd.Env = append(cmd.Env,
-		"CLIENT_CERT_SUBJECT="+clientCert.Subject.String())
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		logging.Printf("Hook co-process %d exited: %v",
+			cmd.Process.Pid, err)
+		stdoutR.Close()
+		close(exited)
+	}()
+
+	logging.Printf("Started hook co-process %d", cmd.Process.Pid)
+	c.cmd = cmd
+	c.stdin = stdinW
+	c.stdout = bufio.NewReader(stdoutR)
+	c.exited = exited
+	return nil
+}
 
-	for i, chain := range chains {
-		cmd.Env = append(cmd.Env,
-			fmt.Sprintf("CHAIN_%d=%s", i, ChainToString(chain)))
+// stop kills the process (if it's still running), so the next request will
+// start a new one.
+func (c *Coprocess) stop() {
+	if c.cmd == nil {
+		return
 	}
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	<-c.exited
+	c.cmd = nil
+}
 
-	_, err = cmd.Output()
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			err = fmt.Errorf("exited with error: %v -- stderr: %q",
-				ee.String(), ee.Stderr)
+// Ask sends the request to the co-process, and waits for its verdict. It
+// returns nil if the request is allowed.
+func (c *Coprocess) Ask(hr *hookRequest, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// If the process died since the last request, clean up and start
+	// again.
+	if c.cmd != nil {
+		select {
+		case <-c.exited:
+			c.stop()
+		default:
+		}
+	}
+
+	if c.cmd == nil {
+		if err := c.start(); err != nil {
+			return fmt.Errorf("error starting co-process: %v", err)
 		}
+	}
+
+	line, err := json.Marshal(hr)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	type result struct {
+		verdict hookVerdict
+		err     error
+	}
+	resultC := make(chan result, 1)
+	stdin, stdout := c.stdin, c.stdout
+	go func() {
+		r := result{}
+		_, r.err = stdin.Write(append(line, '\n'))
+		if r.err != nil {
+			resultC <- r
+			return
+		}
+
+		var resp []byte
+		resp, r.err = stdout.ReadBytes('\n')
+		if r.err == nil {
+			r.err = json.Unmarshal(resp, &r.verdict)
+		}
+		resultC <- r
+	}()
+
+	select {
+	case r := <-resultC:
+		if r.err != nil {
+			// We can't trust the stream is in a consistent state, so
+			// restart the process on the next request.
+			c.stop()
+			return fmt.Errorf("error talking to co-process: %v", r.err)
+		}
+		if !r.verdict.Allow {
+			return fmt.Errorf("denied: %q", r.verdict.Reason)
+		}
+		return nil
+	case <-time.After(timeout):
+		c.stop()
+		return errHookTimeout
+	}
+}
+
+// logWriter is an io.Writer that sends everything written to it to the log,
+// prefixed by the given string.
+type logWriter struct {
+	prefix string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	lines := strings.TrimRight(string(p), "\n")
+	for _, line := range strings.Split(lines, "\n") {
+		logging.Print(w.prefix + line)
+	}
+	return len(p), nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const coprocessHook = `#!/bin/sh
+while read line; do
+	case "$line" in
+	*'"key_path":"allowed"'*)
+		echo '{"allow": true}' ;;
+	*'"key_path":"pid"'*)
+		echo "{\"allow\": false, \"reason\": \"$$\"}" ;;
+	*'"key_path":"crash"'*)
+		exit 1 ;;
+	*'"key_path":"garbage"'*)
+		echo 'this is not json' ;;
+	*'"key_path":"slow"'*)
+		sleep 10; echo '{"allow": true}' ;;
+	*)
+		echo '{"allow": false, "reason": "not today"}' ;;
+	esac
+done
+`
+
+func writeHook(t *testing.T, script string) string {
+	t.Helper()
+	dir := t.TempDir()
+	setFlag(t, dataDir, dir)
+	path := dir + "/hook"
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCoprocess(t *testing.T) {
+	c := NewCoprocess(writeHook(t, coprocessHook))
+	defer c.stop()
+
+	ask := func(key string) error {
+		return c.Ask(&hookRequest{KeyPath: key}, 2*time.Second)
+	}
+
+	if err := ask("allowed"); err != nil {
+		t.Errorf("allowed request was denied: %v", err)
+	}
+	if err := ask("other"); err == nil ||
+		!strings.Contains(err.Error(), "not today") {
+		t.Errorf("unexpected error for denied request: %v", err)
+	}
+
+	// The process should be kept between requests.
+	pid1 := ask("pid")
+	pid2 := ask("pid")
+	if pid1 == nil || pid1.Error() != pid2.Error() {
+		t.Errorf("process changed between requests: %v != %v", pid1, pid2)
+	}
+
+	// Crashes, invalid responses and timeouts are errors, and cause a
+	// restart on the next request.
+	for _, key := range []string{"crash", "garbage", "slow"} {
+		if err := ask(key); err == nil {
+			t.Errorf("%q: expected error, got nil", key)
+		}
+		if err := ask("allowed"); err != nil {
+			t.Errorf("allowed request after %q was denied: %v", key, err)
+		}
+		if pid := ask("pid"); pid.Error() == pid1.Error() {
+			t.Errorf("process not restarted after %q", key)
+		}
+	}
+}
+
+func TestCoprocessNotExecutable(t *testing.T) {
+	path := writeHook(t, coprocessHook)
+	os.Chmod(path, 0600)
+
+	c := NewCoprocess(path)
+	err := c.Ask(&hookRequest{KeyPath: "allowed"}, time.Second)
+	if err == nil {
+		t.Errorf("expected error from non-executable hook, got nil")
+	}
+}
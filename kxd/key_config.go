@@ -3,102 +3,87 @@ package main
 import (
 	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
-func isDir(path string) (bool, error) {
-	fi, err := os.Stat(path)
-	if err != nil {
-		return false, err
-	}
-
-	return fi.IsDir(), nil
-}
-
-func isRegular(path string) (bool, error) {
-	fi, err := os.Stat(path)
-	if err != nil {
-		return false, err
-	}
-
-	return fi.Mode().IsRegular(), nil
-}
-
 // KeyConfig holds the configuration data for a single key.
 type KeyConfig struct {
-	// Path to the configuration directory.
-	ConfigPath string
+	// Path of the key (e.g. "host/key").
+	Path string
 
-	// Paths to the files themselves.
-	keyPath            string
-	allowedClientsPath string
-	allowedHostsPath   string
-	emailToPath        string
+	// Store where the key and its configuration are kept.
+	store Store
 
 	// Allowed certificates.
 	allowedClientCerts *x509.CertPool
 
+	// Fingerprints of the allowed client certificates (see certFingerprint).
+	allowedFingerprints map[string]bool
+
 	// Allowed hosts.
 	allowedHosts []string
 }
 
-// NewKeyConfig makes a new KeyConfig based on the given path. Note that there
-// is no check about the key existing or being valid.
-func NewKeyConfig(configPath string) *KeyConfig {
+// NewKeyConfig makes a new KeyConfig for the key with the given path, in the
+// given store. Note that there is no check about the key existing or being
+// valid.
+func NewKeyConfig(store Store, keyPath string) *KeyConfig {
 	return &KeyConfig{
-		ConfigPath:         configPath,
-		keyPath:            configPath + "/key",
-		allowedClientsPath: configPath + "/allowed_clients",
-		allowedHostsPath:   configPath + "/allowed_hosts",
-		emailToPath:        configPath + "/email_to",
-		allowedClientCerts: x509.NewCertPool(),
+		Path:                keyPath,
+		store:               store,
+		allowedClientCerts:  x509.NewCertPool(),
+		allowedFingerprints: map[string]bool{},
 	}
 }
 
 // Exists checks if this key exists.
 func (kc *KeyConfig) Exists() (bool, error) {
-	isDir, err := isDir(kc.ConfigPath)
-	if os.IsNotExist(err) {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	}
-	if !isDir {
-		return false, nil
-	}
-
-	isRegular, err := isRegular(kc.keyPath)
-	if os.IsNotExist(err) {
-		return false, nil
-	} else if err != nil {
-		return false, err
-	}
+	return kc.store.HasKey(kc.Path)
+}
 
-	return isRegular, nil
+// readFile returns the contents of the key's configuration file with the
+// given name, which may be inherited (see lookupFile).
+func (kc *KeyConfig) readFile(name string) ([]byte, error) {
+	contents, _, err := lookupFile(kc.store, kc.Path, name)
+	return contents, err
 }
 
-// LoadClientCerts loads the client certificates allowed for this key.
+// LoadClientCerts loads the client certificates allowed for this key, from
+// the certificates and fingerprints in allowed_clients, and in the groups it
+// references.
 func (kc *KeyConfig) LoadClientCerts() error {
-	rawContents, err := ioutil.ReadFile(kc.allowedClientsPath)
+	rawContents, err := kc.readFile("allowed_clients")
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
 		return err
 	}
 
-	if !kc.allowedClientCerts.AppendCertsFromPEM(rawContents) {
+	cl, err := parseClientList(rawContents)
+	if err != nil {
+		return err
+	}
+	if cl.empty() {
 		return fmt.Errorf("error parsing client certificate file")
 	}
 
-	return nil
+	return resolveClients(kc.store, cl, nil,
+		func(cl *clientList, _ []string) {
+			for _, cert := range cl.certs {
+				kc.allowedClientCerts.AddCert(cert)
+			}
+			for _, fp := range cl.fingerprints {
+				kc.allowedFingerprints[fp] = true
+			}
+		})
 }
 
 // LoadAllowedHosts loads the hosts allowed for this key.
 func (kc *KeyConfig) LoadAllowedHosts() error {
-	contents, err := ioutil.ReadFile(kc.allowedHostsPath)
+	contents, err := kc.readFile("allowed_hosts")
 	if os.IsNotExist(err) {
 		return nil
 	} else if err != nil {
@@ -136,8 +121,19 @@ type verifyError struct {
 
 // IsAnyCertAllowed checks if any of the given certificates is allowed to
 // access this key. If so, it returns the chain for each of them.
+//
+// Fingerprints are only checked against the first certificate (the client's
+// own), as it's the only one the client proved to have the private key for.
+// Like with the other certificates, pinned ones must be within their validity
+// period; if not, they go through the normal verification, which fails and
+// reports why.
 func (kc *KeyConfig) IsAnyCertAllowed(
 	certs []*x509.Certificate) ([][]*x509.Certificate, []verifyError) {
+	if len(certs) > 0 && kc.allowedFingerprints[certFingerprint(certs[0])] &&
+		isCertCurrent(certs[0], time.Now()) {
+		return [][]*x509.Certificate{{certs[0]}}, nil
+	}
+
 	opts := x509.VerifyOptions{
 		Roots: kc.allowedClientCerts,
 	}
@@ -152,6 +148,23 @@ func (kc *KeyConfig) IsAnyCertAllowed(
 	return nil, errs
 }
 
+// isCertCurrent returns true if the time is within the certificate's
+// validity period.
+func isCertCurrent(cert *x509.Certificate, now time.Time) bool {
+	return !now.Before(cert.NotBefore) && !now.After(cert.NotAfter)
+}
+
+// IsAllowedClient returns true if the given certificates are allowed by the
+// key's allowed_clients, loading them as needed. Errors loading them are
+// taken as not allowed.
+func (kc *KeyConfig) IsAllowedClient(certs []*x509.Certificate) bool {
+	if err := kc.LoadClientCerts(); err != nil {
+		return false
+	}
+	chains, _ := kc.IsAnyCertAllowed(certs)
+	return chains != nil
+}
+
 // IsHostAllowed checks if the given host is allowed to access this key.
 func (kc *KeyConfig) IsHostAllowed(addr string) error {
 	if kc.allowedHosts == nil {
@@ -174,12 +187,12 @@ func (kc *KeyConfig) IsHostAllowed(addr string) error {
 
 // Key returns the private key.
 func (kc *KeyConfig) Key() (key []byte, err error) {
-	return ioutil.ReadFile(kc.keyPath)
+	return kc.store.ReadKey(kc.Path)
 }
 
 // EmailTo returns the list of addresses to email when this key is accessed.
 func (kc *KeyConfig) EmailTo() ([]string, error) {
-	contents, err := ioutil.ReadFile(kc.emailToPath)
+	contents, err := kc.readFile("email_to")
 	if os.IsNotExist(err) {
 		return nil, nil
 	}
@@ -198,3 +211,95 @@ func (kc *KeyConfig) EmailTo() ([]string, error) {
 
 	return emails, nil
 }
+
+// Webhooks returns the list of URLs to notify when this key is accessed.
+func (kc *KeyConfig) Webhooks() ([]string, error) {
+	contents, err := kc.readFile("webhooks")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		url := strings.TrimSpace(line)
+		if !strings.HasPrefix(url, "http://") &&
+			!strings.HasPrefix(url, "https://") {
+			continue
+		}
+		urls = append(urls, url)
+	}
+
+	return urls, nil
+}
+
+// NotifyPolicy returns the notification policy for this key, which
+// determines if notifications must be delivered before releasing the key.
+func (kc *KeyConfig) NotifyPolicy() (string, error) {
+	contents, err := kc.readFile("notify_policy")
+	if os.IsNotExist(err) {
+		return notifyBeforeRelease, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch policy := strings.TrimSpace(string(contents)); policy {
+	case notifyBeforeRelease, notifyEventually:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown notification policy %q", policy)
+	}
+}
+
+// Limits returns the key's access limits, or nil if it has none.
+func (kc *KeyConfig) Limits() (*Limits, error) {
+	contents, err := kc.readFile("limits")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLimits(string(contents))
+}
+
+// Schedule returns the key's access schedule, or nil if it has none.
+func (kc *KeyConfig) Schedule() (*Schedule, error) {
+	contents, err := kc.readFile("schedule")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSchedule(string(contents))
+}
+
+// Labels returns the key's labels, which are arbitrary "name: value" pairs
+// used as metadata (e.g. in notifications).
+func (kc *KeyConfig) Labels() (map[string]string, error) {
+	contents, err := kc.readFile("labels")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
+)
+
+var keyCommandTimeout = flag.Duration(
+	"key_command_timeout", 30*time.Second,
+	"Timeout for running a key's key_command")
+
+var keyCommandMaxSize = flag.Int(
+	"key_command_max_size", 64*1024,
+	"Maximum size of the output of a key's key_command, in bytes")
+
+// Maximum size of the standard error of a key command that we keep, for
+// the error messages.
+const keyCommandMaxStderr = 4 * 1024
+
+// cappedBuffer is a buffer that holds up to max bytes, and discards (but
+// remembers) anything beyond that.
+//
+// The buffer is allocated upfront and never grows, so it doesn't leave
+// copies of its contents behind.
+type cappedBuffer struct {
+	buf      []byte
+	max      int
+	overflow bool
+}
+
+func newCappedBuffer(max int) *cappedBuffer {
+	return &cappedBuffer{buf: make([]byte, 0, max), max: max}
+}
+
+// newLockedCappedBuffer returns a cappedBuffer in locked memory, for
+// holding keys.
+func newLockedCappedBuffer(max int) *cappedBuffer {
+	return &cappedBuffer{buf: keymem.Alloc(max)[:0], max: max}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || len(b.buf)+len(p) > b.max {
+		b.overflow = true
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// ReadFrom reads from r until EOF straight into the buffer, so that
+// io.Copy (which exec uses for the command's output) doesn't need an
+// intermediate buffer, which would be left with a copy of the data.
+func (b *cappedBuffer) ReadFrom(r io.Reader) (int64, error) {
+	total := int64(0)
+	var scratch []byte
+	defer func() { clear(scratch) }()
+
+	for {
+		var n int
+		var err error
+		if !b.overflow && len(b.buf) < b.max {
+			n, err = r.Read(b.buf[len(b.buf):b.max])
+			b.buf = b.buf[:len(b.buf)+n]
+		} else {
+			// Over the limit: read to see if there is more data,
+			// and discard it.
+			if scratch == nil {
+				scratch = make([]byte, 512)
+			}
+			n, err = r.Read(scratch)
+			if n > 0 {
+				b.overflow = true
+			}
+		}
+		total += int64(n)
+
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// wipe overwrites the buffer contents, so they don't linger in memory.
+func (b *cappedBuffer) wipe() {
+	keymem.Wipe(b.buf)
+	b.buf = b.buf[:0]
+}
+
+// runKeyCommand runs the given key command, and returns its standard
+// output, which is the key.
+//
+// The command runs from its own directory, with the same minimal environment
+// as the hook, plus the key path in $KEY_PATH. Its output is never logged or
+// included in the errors; only its standard error is.
+func runKeyCommand(path, keyPath string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		*keyCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = append(baseHookEnv(), "KEY_PATH="+keyPath)
+
+	stdout := newLockedCappedBuffer(*keyCommandMaxSize)
+	stderr := newCappedBuffer(keyCommandMaxStderr)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Don't wait for the output to be closed if the process is gone, in
+	// case some of its children are still holding it.
+	cmd.WaitDelay = 1 * time.Second
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v", *keyCommandTimeout)
+	} else if ee, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("exited with error: %v -- stderr: %q",
+			ee.String(), stderr.buf)
+	} else if err == nil && stdout.overflow {
+		err = fmt.Errorf("output larger than %d bytes",
+			*keyCommandMaxSize)
+	} else if err == nil && len(stdout.buf) == 0 {
+		err = fmt.Errorf("empty output")
+	}
+
+	if err != nil {
+		stdout.wipe()
+		return nil, fmt.Errorf("key_command: %v", err)
+	}
+	return stdout.buf, nil
+}
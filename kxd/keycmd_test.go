@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeyCommand(t *testing.T, path, script string) {
+	t.Helper()
+	writeFile(t, path, "#!/bin/sh\n"+script)
+	if err := os.Chmod(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyCommand(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDirStore(dir)
+	t.Setenv("KXD_TEST_SECRET", "do not leak")
+
+	writeKeyCommand(t, dir+"/host/key/key_command",
+		`echo "key for $KEY_PATH from $PWD, secret: $KXD_TEST_SECRET"`)
+	if ok, err := s.HasKey("host/key"); !ok || err != nil {
+		t.Errorf("HasKey = %v, %v", ok, err)
+	}
+	key, err := s.ReadKey("host/key")
+	expected := "key for host/key from " + dir + "/host/key, secret: \n"
+	if string(key) != expected || err != nil {
+		t.Errorf("ReadKey = %q, %v; expected %q", key, err, expected)
+	}
+
+	// The key file takes precedence.
+	writeFile(t, dir+"/host/key/key", "static")
+	if key, err := s.ReadKey("host/key"); string(key) != "static" ||
+		err != nil {
+		t.Errorf("ReadKey = %q, %v; expected the key file", key, err)
+	}
+
+	setFlag(t, keyCommandMaxSize, 8)
+	setFlag(t, keyCommandTimeout, 200*time.Millisecond)
+
+	// Output of exactly the maximum size is fine.
+	writeKeyCommand(t, dir+"/cmd", "printf 01234567")
+	key, err = runKeyCommand(dir+"/cmd", "key")
+	if string(key) != "01234567" || err != nil {
+		t.Errorf("runKeyCommand = %q, %v; expected 8 bytes", key, err)
+	}
+
+	failures := map[string]string{
+		"echo sekrit; echo oops >&2; exit 1": `stderr: "oops\n"`,
+		"echo 0123456789":                    "output larger than 8 bytes",
+		"true":                               "empty output",
+		"sleep 5":                            "timed out",
+	}
+	for script, errMsg := range failures {
+		path := dir + "/cmd"
+		writeKeyCommand(t, path, script)
+		key, err := runKeyCommand(path, "key")
+		if key != nil || err == nil ||
+			!strings.Contains(err.Error(), errMsg) {
+			t.Errorf("%q: got %q, %v; expected error %q",
+				script, key, err, errMsg)
+		}
+		if err != nil && strings.Contains(err.Error(), "sekrit") {
+			t.Errorf("%q: error contains the output: %v", script, err)
+		}
+	}
+}
@@ -9,22 +9,29 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"log/syslog"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"runtime"
 	"runtime/debug"
 	"strings"
 	"syscall"
 	"time"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
 )
 
 var port = flag.Int(
@@ -33,6 +40,8 @@ var ipAddr = flag.String(
 	"ip_addr", "", "IP address to listen on")
 var dataDir = flag.String(
 	"data_dir", "/etc/kxd/data", "Data directory")
+var stateDir = flag.String(
+	"state_dir", "/var/lib/kxd", "Directory to keep kxd's own state in")
 var certFile = flag.String(
 	"cert", "/etc/kxd/cert.pem", "Certificate")
 var keyFile = flag.String(
@@ -41,29 +50,67 @@ var smtpAddr = flag.String(
 	"smtp_addr", "", "Address of the SMTP server to use to send emails")
 var emailFrom = flag.String(
 	"email_from", "", "Email address to send email from")
-var logFile = flag.String(
-	"logfile", "", "File to write logs to, use '-' for stdout")
 var hookPath = flag.String(
 	"hook", "/etc/kxd/hook",
 	"Hook to run before authorizing keys (skipped if it doesn't exist)")
+var hookMode = flag.String(
+	"hook_mode", "exec",
+	"How to run the hook: 'exec' (once per request) or 'coprocess' "+
+		"(long-running, requests and verdicts over stdin/stdout)")
+var hookTimeout = flag.Duration(
+	"hook_timeout", 1*time.Minute, "Timeout for the hook's verdict")
+var monitoringAddr = flag.String(
+	"monitoring_addr", "",
+	"Address to serve monitoring information on, over plain HTTP "+
+		"(disabled if empty)")
 var versionFlag = flag.Bool(
 	"version", false, "Print version and exit")
 
-// Logger we will use to log entries.
-var logging *log.Logger
+// stringList is a flag.Value for flags that can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
 
 // Request is our wrap around http.Request, so we can augment it with custom
 // methods.
 type Request struct {
 	*http.Request
+
+	// ID of the request, so clients can refer to it (e.g. in bug reports).
+	ID string
+
+	// Reverse DNS lookup of the client's address, for notifications. Nil
+	// if notifications are not sent by email.
+	reverse *reverseLookup
 }
 
-// Printf is a wrapper for fmt.Printf+logging.Output, which prefixes a string
-// identifying this request.
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Printf logs the given message, with attributes identifying this request.
 func (req *Request) Printf(format string, a ...interface{}) {
-	msg := fmt.Sprintf(format, a...)
-	msg = fmt.Sprintf("%s %s %s", req.RemoteAddr, req.URL.Path, msg)
-	logging.Output(2, msg)
+	// Skip [runtime.Callers, Printf], so the source is our caller.
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+
+	r := slog.NewRecord(time.Now(), slog.LevelInfo,
+		fmt.Sprintf(format, a...), pcs[0])
+	r.AddAttrs(
+		slog.String("request_id", req.ID),
+		slog.String("remote_addr", req.RemoteAddr),
+		slog.String("path", req.URL.Path))
+	logger.Handler().Handle(context.Background(), r)
 }
 
 var (
@@ -76,10 +123,13 @@ func (req *Request) KeyPath() (string, error) {
 	// Clean the path to remove any noise.
 	kp := path.Clean(req.URL.Path)
 
-	// Must start with "/v1/". Doing this after the Clean also ensures there
-	// is something else after the version (because Clean removes trailing
-	// slashes).
+	// Must start with "/v1/" or "/v2/". Doing this after the Clean also
+	// ensures there is something else after the version (because Clean
+	// removes trailing slashes).
 	kp, hasVersion := strings.CutPrefix(kp, "/v1/")
+	if !hasVersion {
+		kp, hasVersion = strings.CutPrefix(kp, "/v2/")
+	}
 	if !hasVersion {
 		return "", errInvalidVersion
 	}
@@ -95,6 +145,15 @@ func (req *Request) KeyPath() (string, error) {
 	return kp, nil
 }
 
+// APIVersion returns the version of the protocol used in the request: 2 for
+// "/v2/" requests, and 1 for everything else.
+func (req *Request) APIVersion() int {
+	if strings.HasPrefix(req.URL.Path, "/v2/") {
+		return 2
+	}
+	return 1
+}
+
 func certToString(cert *x509.Certificate) string {
 	return fmt.Sprintf(
 		"(0x%.8s %s)",
@@ -102,6 +161,13 @@ func certToString(cert *x509.Certificate) string {
 		cert.Subject.ToRDNSequence())
 }
 
+// certFingerprint returns the SHA-256 fingerprint of the certificate, in
+// hex.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
 // ChainToString makes a human-readable string out of the given certificate
 // chain.
 func ChainToString(chain []*x509.Certificate) (s string) {
@@ -114,57 +180,116 @@ func ChainToString(chain []*x509.Certificate) (s string) {
 	return s
 }
 
-// HandlerV1 handles /v1/ key requests.
-func HandlerV1(w http.ResponseWriter, httpreq *http.Request) {
-	req := Request{httpreq}
+// KeyHandler handles /v1/ and /v2/ key requests.
+func KeyHandler(w http.ResponseWriter, httpreq *http.Request) {
+	req := Request{Request: httpreq, ID: newRequestID()}
+	w.Header().Set("X-Request-Id", req.ID)
+
+	if mailEnabled() {
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			req.reverse = startReverseLookup(ip)
+		}
+	}
+
+	// Bans are normally enforced during the TLS handshake, but the
+	// connection may have been established before the ban.
+	if ban := bans.CheckRequest(&req); ban != nil {
+		req.Printf("Rejecting request: %s", ban)
+		replyError(w, &req, errCodeBanned, "Too many denied requests")
+		return
+	}
+
 	if len(req.TLS.PeerCertificates) <= 0 {
 		req.Printf("Rejecting request without certificate")
-		http.Error(w, "Client certificate not provided",
-			http.StatusNotAcceptable)
+		denied(nil, &req, "Client certificate not provided")
+		replyError(w, &req, errCodeNoCert,
+			"Client certificate not provided")
 		return
 	}
 
 	keyPath, err := req.KeyPath()
 	if err != nil {
 		req.Printf("Rejecting request with invalid key path: %s", err)
-		http.Error(w, "Invalid key path", http.StatusNotAcceptable)
+		denied(nil, &req, "Invalid key path")
+		replyError(w, &req, errCodeInvalidPath, "Invalid key path")
 		return
 	}
 
-	realKeyPath := path.Join(*dataDir, keyPath)
-	keyConf := NewKeyConfig(realKeyPath)
+	keyConf := NewKeyConfig(keyStore, keyPath)
 
 	exists, err := keyConf.Exists()
 	if err != nil {
 		req.Printf("Error checking key path %q: %s", keyPath, err)
-		http.Error(w, "Error checking key",
-			http.StatusInternalServerError)
+		replyError(w, &req, errCodeInternal, "Error checking key")
 		return
 	}
 	if !exists {
 		req.Printf("Unknown key path %q", keyPath)
-		http.Error(w, "Unknown key", http.StatusNotFound)
+		denied(nil, &req, "Unknown key")
+		replyError(w, &req, errCodeUnknownKey, "Unknown key")
+		return
+	}
+
+	lock, err := lockdown.Check(keyPath, req.TLS.PeerCertificates)
+	if err != nil {
+		// Fail closed, as we can't tell if there's a lock in place.
+		req.Printf("Error checking locks: %s", err)
+		replyError(w, &req, errCodeInternal, "Error checking locks")
+		return
+	}
+	if lock != nil {
+		req.Printf("Rejecting request: %s", lock)
+
+		// The operator's message is only for clients that would otherwise
+		// be allowed; the rest get the same reply as if there was no lock.
+		if !keyConf.IsAllowedClient(req.TLS.PeerCertificates) {
+			denied(keyConf, &req, "No allowed certificate found")
+			replyError(w, &req, errCodeClientNotAllowed,
+				"No allowed certificate found")
+			return
+		}
+
+		keyDenied(keyConf, &req, lock.String(), false)
+		replyError(w, &req, errCodeLocked, lock.String())
 		return
 	}
 
 	if err = keyConf.LoadClientCerts(); err != nil {
 		req.Printf("Error loading certs: %s", err)
-		http.Error(w, "Error loading certs",
-			http.StatusInternalServerError)
+		replyError(w, &req, errCodeInternal, "Error loading certs")
 		return
 	}
 
 	if err = keyConf.LoadAllowedHosts(); err != nil {
 		req.Printf("Error loading allowed hosts: %s", err)
-		http.Error(w, "Error loading allowed hosts",
-			http.StatusInternalServerError)
+		replyError(w, &req, errCodeInternal,
+			"Error loading allowed hosts")
 		return
 	}
 
 	err = keyConf.IsHostAllowed(req.RemoteAddr)
 	if err != nil {
 		req.Printf("Host not allowed: %s", err)
-		http.Error(w, "Host not allowed", http.StatusForbidden)
+		denied(keyConf, &req, "Host not allowed: "+err.Error())
+		replyError(w, &req, errCodeHostNotAllowed, "Host not allowed")
+		return
+	}
+
+	bindMode, err := keyConf.BindClientIP()
+	if err != nil {
+		req.Printf("Error loading client IP binding: %s", err)
+		replyError(w, &req, errCodeInternal,
+			"Error loading client IP binding")
+		return
+	}
+	err = checkClientIP(bindMode, req.RemoteAddr,
+		req.TLS.PeerCertificates[0])
+	if err != nil {
+		req.Printf("Client IP not bound to the certificate: %s", err)
+		denied(keyConf, &req,
+			"Client IP not bound to the certificate: "+err.Error())
+		replyError(w, &req, errCodeIPNotBound,
+			"Client IP does not match the certificate")
 		return
 	}
 
@@ -175,73 +300,152 @@ func HandlerV1(w http.ResponseWriter, httpreq *http.Request) {
 		for i, e := range errs {
 			req.Printf("  %d: %s %v", i, certToString(e.Cert), e.Err)
 		}
-		http.Error(w, "No allowed certificate found",
-			http.StatusForbidden)
+		denied(keyConf, &req, "No allowed certificate found")
+		replyError(w, &req, errCodeClientNotAllowed,
+			"No allowed certificate found")
 		return
 	}
 
-	keyData, err := keyConf.Key()
+	schedule, err := keyConf.Schedule()
 	if err != nil {
-		req.Printf("Error getting key data: %s", err)
-		http.Error(w, "Error getting key data",
-			http.StatusInternalServerError)
+		req.Printf("Error loading schedule: %s", err)
+		replyError(w, &req, errCodeInternal, "Error loading schedule")
 		return
 	}
+	if schedule != nil {
+		if err = schedule.Check(time.Now()); err != nil {
+			req.Printf("Outside of the key's schedule: %s", err)
+			keyDenied(keyConf, &req, "Outside of the key's "+
+				"schedule: "+err.Error(), false)
+			replyError(w, &req, errCodeOutsideSchedule,
+				"Outside of the key's access schedule")
+			return
+		}
+	}
 
 	err = RunHook(keyConf, &req, validChains)
 	if err != nil {
 		req.Printf("Prevented by hook: %s", err)
-		http.Error(w, "Prevented by hook", http.StatusForbidden)
+		denied(keyConf, &req, "Prevented by hook: "+err.Error())
+		replyError(w, &req, errCodeHookDenied, "Prevented by hook")
 		return
 	}
 
-	req.Printf("Allowing request to %s", certToString(validChains[0][0]))
+	if authorizer != nil {
+		err = authorizer.Check(keyConf, &req, validChains)
+		if err != nil {
+			req.Printf("Denied by authorizer: %s", err)
+			denied(keyConf, &req,
+				"Denied by authorizer: "+err.Error())
+			replyError(w, &req, errCodeAuthorizerDenied,
+				"Denied by authorizer")
+			return
+		}
+	}
 
-	err = SendMail(keyConf, &req, validChains)
-	if err != nil {
-		req.Printf("Error sending notification: %s", err)
-		http.Error(w, "Error sending notification",
-			http.StatusInternalServerError)
+	if req.IsMeta() {
+		serveMeta(w, &req, keyConf, validChains)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(keyData)
-}
-
-func initLog() {
-	var err error
-	var logfd io.Writer
+	limits, err := keyConf.Limits()
+	if err != nil {
+		req.Printf("Error loading limits: %s", err)
+		replyError(w, &req, errCodeInternal, "Error loading limits")
+		return
+	}
+	var reservation *Reservation
+	if limits != nil {
+		reservation, err = limitTracker.Use(keyPath,
+			certFingerprint(validChains[0][0]), limits, time.Now())
+		if errors.Is(err, errRateLimited) {
+			req.Printf("Over the key's limits: %s", err)
+			keyDenied(keyConf, &req,
+				"Over the key's limits: "+err.Error(), true)
+			replyError(w, &req, errCodeRateLimited,
+				"Rate limit exceeded")
+			return
+		} else if errors.Is(err, errUsesExhausted) {
+			req.Printf("Over the key's limits: %s", err)
+			keyDenied(keyConf, &req,
+				"Over the key's limits: "+err.Error(), true)
+			replyError(w, &req, errCodeUsesExhausted,
+				"Key use limit reached")
+			return
+		} else if err != nil {
+			req.Printf("Error checking limits: %s", err)
+			replyError(w, &req, errCodeInternal,
+				"Error checking limits")
+			return
+		}
+	}
 
-	if *logFile == "-" {
-		logfd = os.Stdout
-	} else if *logFile != "" {
-		logfd, err = os.OpenFile(*logFile,
-			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-		if err != nil {
-			log.Fatalf("Error opening log file %s: %s",
-				*logFile, err)
+	// The access only counts if the key is given out, so if anything fails
+	// from here on (e.g. the key command, or the notifications), release
+	// it. Otherwise a single use key could be lost without ever being
+	// delivered.
+	given := false
+	defer func() {
+		if given {
+			return
 		}
-	} else {
-		logfd, err = syslog.New(
-			syslog.LOG_INFO|syslog.LOG_DAEMON, "kxd")
-		if err != nil {
-			log.Fatalf("Error opening syslog: %s", err)
+		if err := reservation.Release(); err != nil {
+			req.Printf("Error releasing the key's limits: %s", err)
 		}
+	}()
+
+	// Only get the key once the request is authorized, as it can be
+	// expensive (e.g. if it comes from a key command).
+	keyData, err := keyConf.Key()
+	if err != nil {
+		req.Printf("Error getting key data: %s", err)
+		replyError(w, &req, errCodeInternal, "Error getting key data")
+		return
+	}
+	defer keymem.Wipe(keyData)
+
+	stat, err := keyConf.store.Stat(keyPath)
+	if err != nil {
+		req.Printf("Error getting key version: %s", err)
+		replyError(w, &req, errCodeInternal, "Error getting key data")
+		return
+	}
+
+	req.Printf("Allowing request to %s", certToString(validChains[0][0]))
+
+	ev, err := NewEvent(EventKeyGranted, &req, validChains)
+	if err == nil {
+		err = Notify(keyConf, ev)
+	}
+	if err != nil {
+		req.Printf("Error sending notification: %s", err)
+		replyError(w, &req, errCodeNotifyFailed,
+			"Error sending notification")
+		return
 	}
 
-	logging = log.New(logfd, "",
-		log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
+	given = true
+	replyKey(w, &req, keyData, stat.Version, ev)
+
+	accessTracker.RecordAccess(keyPath, &req, validChains[0][0])
 }
 
-func signalHandler() {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+func signalHandler(signals chan os.Signal) {
 	for {
 		switch sig := <-signals; sig {
 		case syscall.SIGTERM, syscall.SIGINT:
 			logging.Printf("Received signal %s, exiting", sig)
 			os.Exit(0)
+		case syscall.SIGHUP:
+			logging.Printf("Received signal %s, reopening the log "+
+				"and reloading templates", sig)
+			if err := reopenLog(); err != nil {
+				logging.Printf("Error reopening the log: %s", err)
+			}
+			if err := LoadTemplates(keyStore); err != nil {
+				logging.Printf("Error loading templates, "+
+					"keeping the old ones: %s", err)
+			}
 		default:
 			logging.Printf("Received unexpected signal %s", sig)
 		}
@@ -263,6 +467,26 @@ func version() string {
 	return fmt.Sprintf("kxd version %s (%s)", rev, ts)
 }
 
+// serveMonitoring serves the monitoring information (via expvar), and the
+// health and readiness checks, on the given address. It is plain HTTP and
+// unauthenticated, so it should only be exposed to trusted networks.
+func serveMonitoring(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	server := http.Server{
+		Addr:     addr,
+		Handler:  mux,
+		ErrorLog: logging,
+	}
+
+	logging.Printf("Monitoring on %s", addr)
+	err := server.ListenAndServe()
+	logging.Fatalf("Monitoring server failed: %s", err)
+}
+
 func main() {
 	flag.Parse()
 
@@ -271,39 +495,140 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+	}
+
+	// Catch the signals right away, as SIGHUP's default action is to exit,
+	// and it can come early (e.g. from logrotate). They are handled once
+	// we're set up for it, below. There's room for one of each, so none
+	// are dropped in the meantime.
+	signals := make(chan os.Signal, 3)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
 	initLog()
 	logging.Print(version())
 
-	go signalHandler()
+	// Keep the keys out of core dumps and swap, as far as we can.
+	if err := keymem.DisableCoreDumps(); err != nil {
+		logging.Printf("WARNING: Could not disable core dumps: %s", err)
+	}
+	lockTest := make([]byte, 1)
+	if err := keymem.Lock(lockTest); err != nil {
+		logging.Printf("WARNING: Could not lock memory, "+
+			"keys may be swapped out: %s", err)
+	}
+	keymem.Wipe(lockTest)
+
+	store := NewDirStore(*dataDir)
+	if *masterSecretFile != "" {
+		var err error
+		store.MasterSecret, err = loadMasterSecret(*masterSecretFile)
+		if err != nil {
+			logging.Fatalf("Error loading the master secret: %s", err)
+		}
+	}
+	keyStore = store
+
+	if *signingKeyFile != "" {
+		var err error
+		signingKey, err = loadSigningKey(*signingKeyFile)
+		if err != nil {
+			logging.Fatalf("Error loading the signing key: %s", err)
+		}
+	}
+
+	go signalHandler(signals)
+
+	switch *hookMode {
+	case "exec":
+		// Nothing to do here.
+	case "coprocess":
+		hookCoprocess = NewCoprocess(*hookPath)
+	default:
+		logging.Fatalf("Unknown --hook_mode %q", *hookMode)
+	}
+
+	if *authzURL != "" {
+		var err error
+		authorizer, err = NewAuthorizerFromFlags()
+		if err != nil {
+			logging.Fatalf("Error setting up the authorizer: %s", err)
+		}
+	}
+
+	if !mailEnabled() {
+		logging.Print("WARNING: No emails will be sent, " +
+			"use --smtp_addr or --sendmail")
+	}
 
-	if *smtpAddr == "" {
-		logging.Print(
-			"WARNING: No emails will be sent, use --smtp_addr")
+	if err := checkMailFlags(); err != nil {
+		logging.Fatalf("Invalid mail options: %s", err)
+	}
+
+	if err := LoadTemplates(keyStore); err != nil {
+		logging.Fatalf("Error loading templates: %s", err)
 	}
 
 	if *emailFrom == "" {
 		// Try to get a sane default if not provided, using
-		// kxd@<smtp host>.
-		*emailFrom = fmt.Sprintf("kxd@%s",
-			strings.Split(*smtpAddr, ":")[0])
+		// kxd@<smtp host>, or kxd@<our hostname> if using sendmail.
+		host := strings.Split(*smtpAddr, ":")[0]
+		if host == "" {
+			host, _ = os.Hostname()
+		}
+		*emailFrom = fmt.Sprintf("kxd@%s", host)
+	}
+
+	notifySpool = NewSpool(path.Join(*stateDir, "spool"))
+	go notifySpool.Run()
+
+	bans = NewBanList(path.Join(*stateDir, "bans"))
+	limitTracker = NewLimitTracker(path.Join(*stateDir, "limits"))
+	lockdown = NewLockdown(path.Join(*stateDir, "lockdown"))
+	accessTracker = NewAccessTracker(path.Join(*stateDir, "access"))
+
+	if *monitoringAddr != "" {
+		go serveMonitoring(*monitoringAddr)
 	}
 
 	listenAddr := fmt.Sprintf("%s:%d", *ipAddr, *port)
 
 	tlsConfig := tls.Config{
-		ClientAuth: tls.RequireAnyClientCert,
+		ClientAuth:         tls.RequireAnyClientCert,
+		GetConfigForClient: bans.CheckHello,
+		VerifyConnection:   bans.CheckConnection,
 	}
 
+	// Use our own mux, as the default one has debugging handlers
+	// registered (e.g. expvar), which we don't want to expose here.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", KeyHandler)
+	mux.HandleFunc("/v2/", KeyHandler)
+
 	server := http.Server{
 		Addr:      listenAddr,
+		Handler:   mux,
 		TLSConfig: &tlsConfig,
 		ErrorLog:  logging,
 	}
 
-	http.HandleFunc("/v1/", HandlerV1)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if len(trustedProxies) > 0 {
+		trusted, err := parseTrustedProxies(trustedProxies)
+		if err != nil {
+			logging.Fatalf("Invalid --trusted_proxy: %s", err)
+		}
+		listener = newProxyListener(listener, trusted)
+		logging.Printf("Accepting the PROXY protocol from %s",
+			trustedProxies.String())
+	}
 
 	logging.Printf("Listening on %s", listenAddr)
-	err := server.ListenAndServeTLS(*certFile, *keyFile)
+	err = server.ServeTLS(listener, *certFile, *keyFile)
 	if err != nil {
 		logging.Fatal(err)
 	}
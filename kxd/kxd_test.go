@@ -1,19 +1,29 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func init() {
 	// Initialize the global logger. The testing framework will capture the
 	// output and use it as needed.
 	logging = log.Default()
+	logger = slog.Default()
 }
 
 func TestKeyPath(t *testing.T) {
@@ -25,6 +35,7 @@ func TestKeyPath(t *testing.T) {
 		{"/v1/key", "key", nil},
 		{"/v1/path/to/key", "path/to/key", nil},
 		{"/v1/path/to/key/", "path/to/key", nil},
+		{"/v2/path/to/key", "path/to/key", nil},
 
 		{"", "", errInvalidVersion},
 		{"/", "", errInvalidVersion},
@@ -32,14 +43,14 @@ func TestKeyPath(t *testing.T) {
 		{"/v1/", "", errInvalidVersion},
 		{"/v1//", "", errInvalidVersion},
 		{"v1/path/to/key/", "", errInvalidVersion},
-		{"/v2/path/to/key", "", errInvalidVersion},
+		{"/v3/path/to/key", "", errInvalidVersion},
 
 		{"/v1/a..b", "", errHasDotDot},
 	}
 
 	for _, c := range cases {
 		u, _ := url.Parse(c.url)
-		req := Request{&http.Request{
+		req := Request{Request: &http.Request{
 			URL: u,
 		}}
 		got, err := req.KeyPath()
@@ -61,9 +72,64 @@ func TestHandlerWithoutCert(t *testing.T) {
 		TLS: &tls.ConnectionState{},
 	}
 	w := httptest.NewRecorder()
-	HandlerV1(w, req)
+	KeyHandler(w, req)
 	if w.Code != http.StatusNotAcceptable {
-		t.Errorf("HandlerV1(%v) == %d, want %d",
+		t.Errorf("KeyHandler(%v) == %d, want %d",
 			req, w.Code, http.StatusNotAcceptable)
 	}
 }
+
+// newTestCert generates a self-signed certificate for testing, usable for
+// both clients and servers.
+func newTestCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	return newTestCertValid(t, name,
+		time.Now().Add(-1*time.Hour), time.Now().Add(1*time.Hour))
+}
+
+// newTestCertValid is like newTestCert, but with the given validity period.
+func newTestCertValid(t *testing.T, name string,
+	notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{name}},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+}
+
+// newTestRequest returns a Request for the given key, coming from the given
+// address.
+func newTestRequest(key, remoteAddr string) *Request {
+	return &Request{Request: &http.Request{
+		URL:        &url.URL{Path: "/v1/" + key},
+		RemoteAddr: remoteAddr,
+	}}
+}
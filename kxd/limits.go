@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits is the access budget of a key, from its limits file.
+type Limits struct {
+	// Maximum number of accesses per client, and across all clients,
+	// within a period of time. nil if there is no limit.
+	PerClient *rateLimit
+	Rate      *rateLimit
+
+	// Maximum number of accesses in total, 0 if there is no limit.
+	Total int
+}
+
+func (l *Limits) String() string {
+	parts := []string{}
+	if l.PerClient != nil {
+		parts = append(parts, "per_client "+l.PerClient.String())
+	}
+	if l.Rate != nil {
+		parts = append(parts, "rate "+l.Rate.String())
+	}
+	if l.Total > 0 {
+		parts = append(parts, fmt.Sprintf("total %d", l.Total))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+type rateLimit struct {
+	N   int
+	Per time.Duration
+}
+
+func (r *rateLimit) String() string {
+	return fmt.Sprintf("%d/%s", r.N, shortDuration(r.Per))
+}
+
+// shortDuration formats the duration like time.Duration.String, but without
+// the trailing zero units (e.g. "1h" instead of "1h0m0s").
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+func parseRateLimit(s string) (*rateLimit, error) {
+	ns, ds, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid rate %q, expected N/duration", s)
+	}
+	n, err := strconv.Atoi(ns)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid count in rate %q", s)
+	}
+	per, err := time.ParseDuration(ds)
+	if err != nil || per <= 0 {
+		return nil, fmt.Errorf("invalid duration in rate %q", s)
+	}
+	return &rateLimit{n, per}, nil
+}
+
+// parseLimits parses the contents of a limits file, which has one limit per
+// line:
+//
+//	per_client N/duration  at most N accesses per client within duration
+//	rate N/duration        at most N accesses within duration
+//	total N                at most N accesses in total
+//	single_use             same as "total 1"
+func parseLimits(contents string) (*Limits, error) {
+	l := &Limits{}
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "per_client" && len(fields) == 2:
+			l.PerClient, err = parseRateLimit(fields[1])
+		case fields[0] == "rate" && len(fields) == 2:
+			l.Rate, err = parseRateLimit(fields[1])
+		case fields[0] == "total" && len(fields) == 2:
+			l.Total, err = strconv.Atoi(fields[1])
+			if err != nil || l.Total <= 0 {
+				err = fmt.Errorf("invalid total %q", fields[1])
+			}
+		case fields[0] == "single_use" && len(fields) == 1:
+			l.Total = 1
+		default:
+			err = fmt.Errorf("invalid line %q", line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+var (
+	errRateLimited   = errors.New("rate limit exceeded")
+	errUsesExhausted = errors.New("maximum number of uses reached")
+)
+
+// keyUsage is the record of the accesses to a key, used to enforce its
+// limits.
+type keyUsage struct {
+	// Number of accesses in total.
+	Total int
+
+	// Times of the recent accesses, per client (by certificate
+	// fingerprint). Only kept for as long as the rate limits need them.
+	Recent map[string][]time.Time `json:",omitempty"`
+}
+
+// LimitTracker keeps track of the accesses to the keys, to enforce their
+// limits. The records are kept in a keyStateDir.
+type LimitTracker struct {
+	dir keyStateDir
+
+	// Serializes the checks, so concurrent requests can't go over the
+	// limits.
+	mu sync.Mutex
+}
+
+// The global limit tracker.
+var limitTracker *LimitTracker
+
+// NewLimitTracker returns a new LimitTracker using the given directory,
+// which will be created if needed.
+func NewLimitTracker(dir string) *LimitTracker {
+	return &LimitTracker{dir: keyStateDir(dir)}
+}
+
+func (t *LimitTracker) load(keyPath string) (*keyUsage, error) {
+	u := &keyUsage{}
+	err := t.dir.load(keyPath, u)
+	return u, err
+}
+
+// Uses returns how many times the key has been accessed so far.
+func (t *LimitTracker) Uses(keyPath string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, err := t.load(keyPath)
+	if err != nil {
+		return 0, err
+	}
+	return u.Total, nil
+}
+
+// Use checks if the client can access the key within its limits, and if
+// so, records the access. Returns an error wrapping errRateLimited or
+// errUsesExhausted if the limits don't allow it.
+//
+// The access is reserved, so concurrent requests can't go over the limits;
+// if the key ends up not being given out, the caller must release it (see
+// Reservation).
+func (t *LimitTracker) Use(keyPath, client string, l *Limits,
+	now time.Time) (*Reservation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, err := t.load(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Total > 0 && u.Total >= l.Total {
+		return nil, fmt.Errorf("%w (%d)", errUsesExhausted, l.Total)
+	}
+
+	// Forget the accesses that are too old to matter.
+	var keep time.Duration
+	if l.PerClient != nil {
+		keep = l.PerClient.Per
+	}
+	if l.Rate != nil && l.Rate.Per > keep {
+		keep = l.Rate.Per
+	}
+	recent := map[string][]time.Time{}
+	for c, times := range u.Recent {
+		for _, ts := range times {
+			if now.Sub(ts) < keep {
+				recent[c] = append(recent[c], ts)
+			}
+		}
+	}
+
+	countSince := func(times []time.Time, per time.Duration) int {
+		n := 0
+		for _, ts := range times {
+			if now.Sub(ts) < per {
+				n++
+			}
+		}
+		return n
+	}
+
+	if l.PerClient != nil &&
+		countSince(recent[client], l.PerClient.Per) >= l.PerClient.N {
+		return nil, fmt.Errorf("%w (%s per client)",
+			errRateLimited, l.PerClient)
+	}
+	if l.Rate != nil {
+		n := 0
+		for _, times := range recent {
+			n += countSince(times, l.Rate.Per)
+		}
+		if n >= l.Rate.N {
+			return nil, fmt.Errorf("%w (%s)", errRateLimited, l.Rate)
+		}
+	}
+
+	u.Total++
+	if keep > 0 {
+		recent[client] = append(recent[client], now)
+	}
+	u.Recent = recent
+
+	if err := t.dir.save(keyPath, u); err != nil {
+		return nil, err
+	}
+	return &Reservation{t, keyPath, client, now}, nil
+}
+
+// Reservation is an access recorded by LimitTracker.Use.
+type Reservation struct {
+	t       *LimitTracker
+	keyPath string
+	client  string
+	time    time.Time
+}
+
+// Release undoes the access, for when the key could not be given out (for
+// example, because the key command or the notifications failed), so that it
+// doesn't count towards the limits. Releasing a nil Reservation does
+// nothing.
+func (r *Reservation) Release() error {
+	if r == nil {
+		return nil
+	}
+
+	t := r.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, err := t.load(r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	if u.Total > 0 {
+		u.Total--
+	}
+	times := u.Recent[r.client]
+	for i, ts := range times {
+		if ts.Equal(r.time) {
+			u.Recent[r.client] = append(times[:i], times[i+1:]...)
+			break
+		}
+	}
+	if len(u.Recent[r.client]) == 0 {
+		delete(u.Recent, r.client)
+	}
+
+	return t.dir.save(r.keyPath, u)
+}
+
+// Reset forgets the accesses to the key, so its limits start over.
+func (t *LimitTracker) Reset(keyPath string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.dir.remove(keyPath)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	cases := []struct {
+		contents string
+		expected *Limits
+	}{
+		{"", &Limits{}},
+		{"# Comment\n\nper_client 3/1h\n", &Limits{
+			PerClient: &rateLimit{3, time.Hour}}},
+		{"rate 10/24h\ntotal 100\n", &Limits{
+			Rate: &rateLimit{10, 24 * time.Hour}, Total: 100}},
+		{"single_use", &Limits{Total: 1}},
+	}
+	for _, c := range cases {
+		l, err := parseLimits(c.contents)
+		if err != nil {
+			t.Errorf("%q: error: %v", c.contents, err)
+			continue
+		}
+		if !reflect.DeepEqual(l, c.expected) {
+			t.Errorf("%q: got %+v, expected %+v",
+				c.contents, l, c.expected)
+		}
+	}
+
+	invalid := []string{
+		"per_client 3",
+		"per_client 3/blah",
+		"per_client 0/1h",
+		"rate x/1h",
+		"total -1",
+		"total 1 2",
+		"single_use 2",
+		"unknown",
+	}
+	for _, contents := range invalid {
+		if _, err := parseLimits(contents); err == nil {
+			t.Errorf("%q: parsed without errors", contents)
+		}
+	}
+}
+
+func TestLimitTracker(t *testing.T) {
+	tr := NewLimitTracker(t.TempDir())
+	now := time.Now()
+
+	use := func(key, client string, l *Limits, when time.Time,
+		expected error) {
+		t.Helper()
+		_, err := tr.Use(key, client, l, when)
+		if !errors.Is(err, expected) {
+			t.Errorf("Use(%q, %q, %v) = %v, expected %v",
+				key, client, when.Sub(now), err, expected)
+		}
+	}
+
+	// Per client rate.
+	l := &Limits{PerClient: &rateLimit{2, time.Hour}}
+	use("k1", "c1", l, now, nil)
+	use("k1", "c1", l, now.Add(time.Minute), nil)
+	use("k1", "c1", l, now.Add(2*time.Minute), errRateLimited)
+	use("k1", "c2", l, now.Add(2*time.Minute), nil)
+	use("k1", "c1", l, now.Add(61*time.Minute), nil)
+
+	// Rate across all clients.
+	l = &Limits{Rate: &rateLimit{2, time.Hour}}
+	use("host/k2", "c1", l, now, nil)
+	use("host/k2", "c2", l, now, nil)
+	use("host/k2", "c3", l, now, errRateLimited)
+
+	// Single use, which must survive restarts and can be reset.
+	l = &Limits{Total: 1}
+	use("k3", "c1", l, now, nil)
+	tr = NewLimitTracker(string(tr.dir))
+	use("k3", "c1", l, now.Add(24*time.Hour), errUsesExhausted)
+	use("k3", "c2", l, now.Add(24*time.Hour), errUsesExhausted)
+	if err := tr.Reset("k3"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	use("k3", "c2", l, now, nil)
+
+	// Released accesses don't count, for either kind of limit.
+	l = &Limits{PerClient: &rateLimit{1, time.Hour}, Total: 1}
+	r, err := tr.Use("k4", "c1", l, now)
+	if err != nil {
+		t.Fatalf("Use: %v", err)
+	}
+	if err := r.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	use("k4", "c1", l, now.Add(time.Minute), nil)
+	use("k4", "c1", l, now.Add(2*time.Minute), errUsesExhausted)
+
+	// Releasing a nil reservation (when there are no limits) is fine.
+	if err := (*Reservation)(nil).Release(); err != nil {
+		t.Errorf("nil Release: %v", err)
+	}
+}
+
+func TestLimitsReleasedOnFailure(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+	stub := &webhookStub{status: http.StatusInternalServerError}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writeKeyCommand(t, dir+"/broken/key_command", "exit 1\n")
+	writeFile(t, dir+"/notify/key", "sekrit")
+	writeFile(t, dir+"/notify/webhooks", srv.URL+"\n")
+	for _, key := range []string{"broken", "notify"} {
+		writeFile(t, dir+"/"+key+"/allowed_clients", certPEM(cert))
+		writeFile(t, dir+"/"+key+"/limits", "single_use\n")
+	}
+
+	setFlag(t, &keyStore, Store(NewDirStore(dir)))
+	setFlag(t, &lockdown, NewLockdown(t.TempDir()))
+	setFlag(t, &limitTracker, NewLimitTracker(t.TempDir()))
+	setFlag(t, &accessTracker, NewAccessTracker(t.TempDir()))
+	setFlag(t, &notifySpool, NewSpool(t.TempDir()))
+
+	get := func(keyPath string) int {
+		t.Helper()
+		u, _ := url.Parse("/v1/" + keyPath)
+		req := &http.Request{
+			URL:        u,
+			RemoteAddr: "192.0.2.1:1234",
+			TLS: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		return w.Code
+	}
+
+	// Neither the key command failing, nor the notifications failing,
+	// use up the key.
+	for _, keyPath := range []string{"broken", "notify"} {
+		for i := 0; i < 2; i++ {
+			if code := get(keyPath); code != http.StatusInternalServerError {
+				t.Errorf("%s: got %d, expected 500", keyPath, code)
+			}
+		}
+		if uses, err := limitTracker.Uses(keyPath); uses != 0 || err != nil {
+			t.Errorf("%s: %d uses recorded (%v)", keyPath, uses, err)
+		}
+	}
+
+	// Once the notifications work, the key can be used, but only once.
+	stub.status = http.StatusOK
+	if code := get("notify"); code != http.StatusOK {
+		t.Errorf("notify: got %d, expected 200", code)
+	}
+	if code := get("notify"); code != http.StatusGone {
+		t.Errorf("notify: got %d, expected 410", code)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lockdown holds the emergency locks, which deny access regardless of the
+// keys' configuration. They are stored as files in the lockdown directory,
+// containing the operator's message:
+//
+//	panic                  locks everything
+//	keys/<key>.lock        locks the key (e.g. "keys/host/key.lock")
+//	clients/<fingerprint>  locks the client certificate, for all keys
+//
+// They are checked on every request, so they take effect immediately, and
+// persist across restarts.
+type Lockdown struct {
+	dir string
+}
+
+// The global lockdown.
+var lockdown *Lockdown
+
+// NewLockdown returns a new Lockdown using the given directory, which will
+// be created if needed.
+func NewLockdown(dir string) *Lockdown {
+	return &Lockdown{dir: dir}
+}
+
+// Lock is a single lock.
+type Lock struct {
+	// What is locked: "server", "key <key>", or "client <fingerprint>".
+	What string
+
+	// Message from the operator.
+	Message string
+}
+
+func (l *Lock) String() string {
+	return fmt.Sprintf("%s locked: %s", l.What, l.Message)
+}
+
+func (ld *Lockdown) panicPath() string {
+	return filepath.Join(ld.dir, "panic")
+}
+
+// Suffix of the key lock files. Keys can be nested (e.g. "host" and
+// "host/disk1"), so without it a key's lock file would be in the way of its
+// children's.
+const keyLockSuffix = ".lock"
+
+func (ld *Lockdown) keyPath(keyPath string) string {
+	return filepath.Join(ld.dir, "keys",
+		filepath.FromSlash(keyPath)+keyLockSuffix)
+}
+
+func (ld *Lockdown) clientPath(fingerprint string) string {
+	return filepath.Join(ld.dir, "clients", fingerprint)
+}
+
+// readLock reads the lock at the given path, returning nil if there is
+// none.
+func readLock(path, what string) (*Lock, error) {
+	msg, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &Lock{What: what, Message: strings.TrimSpace(string(msg))}, nil
+}
+
+// Check returns the lock that applies to a request for the given key, with
+// the given certificates, or nil if there is none.
+func (ld *Lockdown) Check(keyPath string,
+	certs []*x509.Certificate) (*Lock, error) {
+	lock, err := readLock(ld.panicPath(), "server")
+	if lock != nil || err != nil {
+		return lock, err
+	}
+
+	lock, err = readLock(ld.keyPath(keyPath), "key "+keyPath)
+	if lock != nil || err != nil {
+		return lock, err
+	}
+
+	// Check all the certificates, so locking a CA locks all the clients
+	// that present it.
+	for _, cert := range certs {
+		fp := certFingerprint(cert)
+		lock, err = readLock(ld.clientPath(fp), "client "+fp)
+		if lock != nil || err != nil {
+			return lock, err
+		}
+	}
+
+	return nil, nil
+}
+
+// LockAll locks the whole server (panic mode).
+func (ld *Lockdown) LockAll(msg string) error {
+	return writeFileAtomic(ld.panicPath(), []byte(msg+"\n"))
+}
+
+// LockKey locks the given key.
+func (ld *Lockdown) LockKey(keyPath, msg string) error {
+	return writeFileAtomic(ld.keyPath(keyPath), []byte(msg+"\n"))
+}
+
+// LockClient locks the client certificate with the given fingerprint.
+func (ld *Lockdown) LockClient(fingerprint, msg string) error {
+	if err := checkFingerprint(fingerprint); err != nil {
+		return err
+	}
+	return writeFileAtomic(ld.clientPath(fingerprint), []byte(msg+"\n"))
+}
+
+func removeLock(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("not locked")
+	}
+	return err
+}
+
+// UnlockAll leaves panic mode.
+func (ld *Lockdown) UnlockAll() error {
+	return removeLock(ld.panicPath())
+}
+
+// UnlockKey unlocks the given key.
+func (ld *Lockdown) UnlockKey(keyPath string) error {
+	return removeLock(ld.keyPath(keyPath))
+}
+
+// UnlockClient unlocks the client certificate with the given fingerprint.
+func (ld *Lockdown) UnlockClient(fingerprint string) error {
+	if err := checkFingerprint(fingerprint); err != nil {
+		return err
+	}
+	return removeLock(ld.clientPath(fingerprint))
+}
+
+// checkFingerprint checks the string is a valid certificate fingerprint,
+// as returned by certFingerprint.
+func checkFingerprint(fp string) error {
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != 32 ||
+		fp != strings.ToLower(fp) {
+		return fmt.Errorf("invalid fingerprint %q, expected SHA-256 "+
+			"in lowercase hex", fp)
+	}
+	return nil
+}
+
+// List returns all the locks.
+func (ld *Lockdown) List() ([]*Lock, error) {
+	locks := []*Lock{}
+
+	lock, err := readLock(ld.panicPath(), "server")
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		locks = append(locks, lock)
+	}
+
+	dirs := []struct{ dir, what, suffix string }{
+		{filepath.Join(ld.dir, "keys"), "key", keyLockSuffix},
+		{filepath.Join(ld.dir, "clients"), "client", ""},
+	}
+	for _, d := range dirs {
+		err := filepath.WalkDir(d.dir,
+			func(path string, e fs.DirEntry, err error) error {
+				if err != nil && path == d.dir && os.IsNotExist(err) {
+					return nil
+				}
+				if err != nil || e.IsDir() ||
+					strings.HasPrefix(e.Name(), ".") ||
+					!strings.HasSuffix(e.Name(), d.suffix) {
+					return err
+				}
+
+				name, _ := filepath.Rel(d.dir, path)
+				name = strings.TrimSuffix(name, d.suffix)
+				lock, err := readLock(path,
+					d.what+" "+filepath.ToSlash(name))
+				if lock != nil {
+					locks = append(locks, lock)
+				}
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locks, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestLockdown(t *testing.T) {
+	ld := NewLockdown(t.TempDir())
+	cert := newTestCert(t, "client").Leaf
+	other := newTestCert(t, "other").Leaf
+	fp := certFingerprint(cert)
+
+	check := func(key string, certs []*x509.Certificate, expected string) {
+		t.Helper()
+		lock, err := ld.Check(key, certs)
+		if err != nil {
+			t.Fatalf("Check(%q): %v", key, err)
+		}
+		got := ""
+		if lock != nil {
+			got = lock.String()
+		}
+		if got != expected {
+			t.Errorf("Check(%q) = %q, expected %q", key, got, expected)
+		}
+	}
+
+	check("host/key", []*x509.Certificate{cert}, "")
+
+	if err := ld.LockKey("host/key", "Compromised, call x123"); err != nil {
+		t.Fatalf("LockKey: %v", err)
+	}
+	check("host/key", nil, "key host/key locked: Compromised, call x123")
+	check("host/other", nil, "")
+
+	// Client locks apply to all keys, and to any of the certificates the
+	// client presents.
+	if err := ld.LockClient(fp, "Stolen laptop"); err != nil {
+		t.Fatalf("LockClient: %v", err)
+	}
+	check("host/other", []*x509.Certificate{other, cert},
+		"client "+fp+" locked: Stolen laptop")
+	check("host/other", []*x509.Certificate{other}, "")
+
+	// Panic mode locks everything.
+	if err := ld.LockAll("Panic"); err != nil {
+		t.Fatalf("LockAll: %v", err)
+	}
+	check("host/other", []*x509.Certificate{other}, "server locked: Panic")
+
+	locks, err := ld.List()
+	if err != nil || len(locks) != 3 {
+		t.Errorf("List() = %v, %v", locks, err)
+	}
+
+	for _, err := range []error{
+		ld.UnlockAll(), ld.UnlockKey("host/key"), ld.UnlockClient(fp)} {
+		if err != nil {
+			t.Errorf("unlock error: %v", err)
+		}
+	}
+	check("host/key", []*x509.Certificate{cert}, "")
+
+	// Nested keys can be locked independently.
+	for _, key := range []string{"host/key/child", "host/key"} {
+		if err := ld.LockKey(key, "Nested"); err != nil {
+			t.Fatalf("LockKey(%q): %v", key, err)
+		}
+	}
+	check("host", nil, "")
+	check("host/key", nil, "key host/key locked: Nested")
+	check("host/key/child", nil, "key host/key/child locked: Nested")
+	locks, err = ld.List()
+	listed := map[string]bool{}
+	for _, l := range locks {
+		listed[l.What] = true
+	}
+	if err != nil || len(locks) != 2 || !listed["key host/key"] ||
+		!listed["key host/key/child"] {
+		t.Errorf("List() = %v, %v", locks, err)
+	}
+	if err := ld.UnlockKey("host/key"); err != nil {
+		t.Errorf("UnlockKey: %v", err)
+	}
+	check("host/key", nil, "")
+	check("host/key/child", nil, "key host/key/child locked: Nested")
+	if err := ld.UnlockKey("host/key/child"); err != nil {
+		t.Errorf("UnlockKey: %v", err)
+	}
+
+	if err := ld.UnlockKey("host/key"); err == nil {
+		t.Errorf("unlocking an unlocked key did not fail")
+	}
+	for _, fp := range []string{"", "abc", "../../etc/passwd",
+		"ABCD" + fp[4:]} {
+		if err := ld.LockClient(fp, "msg"); err == nil {
+			t.Errorf("LockClient(%q) did not fail", fp)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var logFile = flag.String(
+	"logfile", "", "File to write logs to, use '-' for stdout")
+var logFormat = flag.String(
+	"log_format", "text", "Format of the logs: 'text' or 'json'")
+
+// Structured logger we will use to log entries.
+var logger *slog.Logger
+
+// Logger for plain messages; it writes to the structured logger.
+var logging *log.Logger
+
+// The log file, if we are logging to one, so it can be reopened.
+var logfd *reopenableFile
+
+func initLog() {
+	var err error
+	var w io.Writer
+
+	if *logFile == "-" {
+		w = os.Stdout
+	} else if *logFile != "" {
+		logfd, err = openLogFile(*logFile)
+		if err != nil {
+			log.Fatalf("Error opening log file %s: %s",
+				*logFile, err)
+		}
+		w = logfd
+	} else {
+		w, err = syslog.New(
+			syslog.LOG_INFO|syslog.LOG_DAEMON, "kxd")
+		if err != nil {
+			log.Fatalf("Error opening syslog: %s", err)
+		}
+	}
+
+	h, err := newLogHandler(w, *logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setLogHandler(h)
+}
+
+// newLogHandler returns a log handler writing to w in the given format.
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		ReplaceAttr: shortSource,
+	}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown --log_format %q", format)
+	}
+}
+
+// setLogHandler sets up the global loggers to use the given handler.
+func setLogHandler(h slog.Handler) {
+	logger = slog.New(h)
+	logging = slog.NewLogLogger(h, slog.LevelInfo)
+}
+
+// shortSource replaces the source of log entries with just the file name
+// and line, like log.Lshortfile does.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.SourceKey || len(groups) > 0 {
+		return a
+	}
+	if src, ok := a.Value.Any().(*slog.Source); ok {
+		a.Value = slog.StringValue(
+			fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+	}
+	return a
+}
+
+// reopenLog reopens the log file, if we are logging to one. This is needed
+// for log rotation: the old file gets renamed, and then we get a signal to
+// start writing to a new one.
+func reopenLog() error {
+	if logfd == nil {
+		return nil
+	}
+	return logfd.Reopen()
+}
+
+// reopenableFile is an io.Writer that appends to a file, which can be
+// reopened at any time.
+type reopenableFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*reopenableFile, error) {
+	rf := &reopenableFile{path: path}
+	if err := rf.Reopen(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *reopenableFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Write(p)
+}
+
+// Reopen opens the file at the path again. On errors, it keeps writing to
+// the old one.
+func (rf *reopenableFile) Reopen() error {
+	f, err := os.OpenFile(rf.path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		rf.f.Close()
+	}
+	rf.f = f
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFormats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h, err := newLogHandler(buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &logger, logger)
+	setFlag(t, &logging, logging)
+	setLogHandler(h)
+
+	req := newTestRequest("host/key", "192.0.2.1:1234")
+	req.ID = "0123456789abcdef"
+	req.Printf("Allowing request %d", 1)
+	logging.Printf("Plain message")
+
+	dec := json.NewDecoder(buf)
+	entry := map[string]string{}
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"level":       "INFO",
+		"msg":         "Allowing request 1",
+		"request_id":  "0123456789abcdef",
+		"remote_addr": "192.0.2.1:1234",
+		"path":        "/v1/host/key",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s: got %q, want %q", k, entry[k], v)
+		}
+	}
+	if !strings.HasPrefix(entry["source"], "logging_test.go:") {
+		t.Errorf("unexpected source %q", entry["source"])
+	}
+
+	entry = map[string]string{}
+	if err := dec.Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "Plain message" ||
+		!strings.HasPrefix(entry["source"], "logging_test.go:") {
+		t.Errorf("unexpected plain entry: %v", entry)
+	}
+
+	buf.Reset()
+	h, err = newLogHandler(buf, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLogHandler(h)
+	req.Printf("Allowing request")
+	if s := buf.String(); !strings.Contains(s,
+		`msg="Allowing request" request_id=0123456789abcdef`) {
+		t.Errorf("unexpected text entry: %q", s)
+	}
+
+	if _, err := newLogHandler(buf, "xml"); err == nil {
+		t.Errorf("newLogHandler accepted an unknown format")
+	}
+}
+
+func TestReopenLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log")
+
+	rf, err := openLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("first\n"))
+
+	// Rotate the file, like logrotate would.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("second\n"))
+
+	for p, want := range map[string]string{
+		path + ".1": "first\n",
+		path:        "second\n",
+	} {
+		got, err := os.ReadFile(p)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v; want %q", p, got, err, want)
+		}
+	}
+
+	// Reopening a file we can't open keeps the old one.
+	rf.path = filepath.Join(dir, "does/not/exist")
+	if err := rf.Reopen(); err == nil {
+		t.Errorf("reopening a missing directory succeeded")
+	}
+	rf.Write([]byte("third\n"))
+	if got, _ := os.ReadFile(path); string(got) != "second\nthird\n" {
+		t.Errorf("after failed reopen: got %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// IsMeta returns whether this is a request for the key's metadata (with
+// "?meta"), instead of the key itself.
+func (req *Request) IsMeta() bool {
+	_, ok := req.URL.Query()["meta"]
+	return ok
+}
+
+// keyMeta is the metadata of a key, as returned to the clients on "?meta"
+// requests. It never includes the key itself.
+type keyMeta struct {
+	Key string `json:"key"`
+
+	// Where the key comes from (see KeyStat).
+	Source string `json:"source"`
+
+	// Version of derived keys.
+	Version int `json:"version,omitempty"`
+
+	// Size of the key, in bytes, and its SHA-256 in hex. Only for static
+	// keys (see Store.Digest), as producing the others just for this
+	// would be as costly as a real access, and could have side effects.
+	Size   int    `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// When the key was last changed, if known.
+	LastRotation *time.Time `json:"last_rotation,omitempty"`
+}
+
+// serveMeta serves the metadata of the key, for an authorized request.
+//
+// Metadata requests are not key accesses: they don't count towards the
+// key's limits, and don't cause notifications.
+func serveMeta(w http.ResponseWriter, req *Request, kc *KeyConfig,
+	chains [][]*x509.Certificate) {
+	stat, err := kc.store.Stat(kc.Path)
+	if err != nil {
+		req.Printf("Error getting key metadata: %s", err)
+		replyError(w, req, errCodeInternal,
+			"Error getting key metadata")
+		return
+	}
+
+	digest, err := kc.store.Digest(kc.Path)
+	if err != nil {
+		req.Printf("Error getting key digest: %s", err)
+		replyError(w, req, errCodeInternal,
+			"Error getting key metadata")
+		return
+	}
+
+	meta := &keyMeta{
+		Key:     kc.Path,
+		Source:  stat.Source,
+		Version: stat.Version,
+	}
+	if digest != nil {
+		meta.Size = digest.Size
+		meta.SHA256 = hex.EncodeToString(digest.SHA256[:])
+	}
+	if !stat.ModTime.IsZero() {
+		meta.LastRotation = &stat.ModTime
+	}
+
+	req.Printf("Allowing metadata request to %s",
+		certToString(chains[0][0]))
+
+	replyMeta(w, req, meta)
+
+	accessTracker.RecordMetaAccess(kc.Path, req, chains[0][0])
+}
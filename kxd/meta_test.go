@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetaRequests(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+	stub := &webhookStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	s := NewMemStore()
+	s.Set("host/key", "key", []byte("sekrit"))
+	s.Set("host/key", "allowed_clients", []byte(certPEM(cert)))
+	s.Set("host/key", "limits", []byte("single_use\n"))
+	s.Set("host/key", "webhooks", []byte(srv.URL+"\n"))
+
+	oldStore, oldLockdown, oldLimits, oldTracker, oldSpool :=
+		keyStore, lockdown, limitTracker, accessTracker, notifySpool
+	keyStore = s
+	lockdown = NewLockdown(t.TempDir())
+	limitTracker = NewLimitTracker(t.TempDir())
+	accessTracker = NewAccessTracker(t.TempDir())
+	notifySpool = NewSpool(t.TempDir())
+	defer func() {
+		keyStore, lockdown, limitTracker, accessTracker, notifySpool =
+			oldStore, oldLockdown, oldLimits, oldTracker, oldSpool
+	}()
+
+	get := func(rawURL string) *httptest.ResponseRecorder {
+		t.Helper()
+		u, _ := url.Parse(rawURL)
+		req := &http.Request{
+			URL:        u,
+			RemoteAddr: "192.0.2.1:1234",
+			TLS: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		return w
+	}
+
+	// Metadata requests can be repeated, as they don't count towards the
+	// limits, and don't notify.
+	for i := 0; i < 2; i++ {
+		w := get("/v1/host/key?meta")
+		if w.Code != http.StatusOK {
+			t.Fatalf("meta request failed: %d %s", w.Code, w.Body)
+		}
+		meta := &keyMeta{}
+		if err := json.Unmarshal(w.Body.Bytes(), meta); err != nil {
+			t.Fatalf("invalid JSON %q: %v", w.Body, err)
+		}
+		sum := sha256.Sum256([]byte("sekrit"))
+		if meta.Key != "host/key" || meta.Source != "memory" ||
+			meta.Size != 6 || meta.SHA256 != hex.EncodeToString(sum[:]) ||
+			meta.LastRotation == nil {
+			t.Errorf("unexpected metadata: %+v", meta)
+		}
+	}
+	if len(stub.payloads) != 0 {
+		t.Errorf("metadata requests caused notifications: %v",
+			stub.payloads)
+	}
+
+	ka, _ := accessTracker.Load("host/key")
+	if ka.Accesses != 0 || ka.MetaAccesses != 2 {
+		t.Errorf("unexpected access history: %+v", ka)
+	}
+
+	// The key itself can still be used once.
+	if w := get("/v1/host/key"); w.Code != http.StatusOK ||
+		w.Body.String() != "sekrit" {
+		t.Errorf("key request failed: %d %s", w.Code, w.Body)
+	}
+	if len(stub.payloads) != 1 {
+		t.Errorf("expected 1 notification, got %d", len(stub.payloads))
+	}
+	if w := get("/v1/host/key"); w.Code != http.StatusGone {
+		t.Errorf("key used twice: %d", w.Code)
+	}
+}
+
+func TestDirStoreStat(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDirStore(dir)
+	writeFile(t, dir+"/file/key", "key")
+	writeKeyCommand(t, dir+"/cmd/key_command", "echo key")
+	writeFile(t, dir+"/derived/derive", "version 3\n")
+
+	cases := map[string]struct {
+		source  string
+		version int
+		modTime bool
+	}{
+		"file":    {"file", 0, true},
+		"cmd":     {"command", 0, false},
+		"derived": {"derived", 3, true},
+	}
+	for keyPath, c := range cases {
+		stat, err := s.Stat(keyPath)
+		if err != nil {
+			t.Errorf("%s: Stat: %v", keyPath, err)
+			continue
+		}
+		if stat.Source != c.source || stat.Version != c.version ||
+			stat.ModTime.IsZero() == c.modTime {
+			t.Errorf("%s: unexpected stat %+v", keyPath, stat)
+		}
+
+		// Only key files have a digest.
+		digest, err := s.Digest(keyPath)
+		if err != nil || (digest != nil) != (c.source == "file") {
+			t.Errorf("%s: Digest = %+v, %v", keyPath, digest, err)
+		}
+	}
+
+	digest, _ := s.Digest("file")
+	if digest.Size != 3 || digest.SHA256 != sha256.Sum256([]byte("key")) {
+		t.Errorf("unexpected digest of the key file: %+v", digest)
+	}
+}
+
+func TestMetaDoesNotProduceKey(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+	dir := t.TempDir()
+	s := NewDirStore(dir)
+	s.MasterSecret = []byte(strings.Repeat("s", minMasterSecretLen))
+	writeKeyCommand(t, dir+"/cmd/key_command",
+		"touch "+dir+"/ran\necho key\n")
+	writeFile(t, dir+"/cmd/allowed_clients", certPEM(cert))
+	writeFile(t, dir+"/derived/derive", "version 3\n")
+	writeFile(t, dir+"/derived/allowed_clients", certPEM(cert))
+
+	setFlag(t, &keyStore, Store(s))
+	setFlag(t, &lockdown, NewLockdown(t.TempDir()))
+	setFlag(t, &limitTracker, NewLimitTracker(t.TempDir()))
+	setFlag(t, &accessTracker, NewAccessTracker(t.TempDir()))
+	setFlag(t, &notifySpool, NewSpool(t.TempDir()))
+
+	for _, keyPath := range []string{"cmd", "derived"} {
+		u, _ := url.Parse("/v1/" + keyPath + "?meta")
+		req := &http.Request{
+			URL:        u,
+			RemoteAddr: "192.0.2.1:1234",
+			TLS: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: meta request failed: %d %s",
+				keyPath, w.Code, w.Body)
+		}
+
+		meta := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", keyPath, w.Body, err)
+		}
+		if _, ok := meta["size"]; ok {
+			t.Errorf("%s: size given: %v", keyPath, meta)
+		}
+		if _, ok := meta["sha256"]; ok {
+			t.Errorf("%s: sha256 given: %v", keyPath, meta)
+		}
+	}
+
+	if _, err := os.Stat(dir + "/ran"); !os.IsNotExist(err) {
+		t.Errorf("key_command was run for a meta request (%v)", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var notifyMaxAge = flag.Duration(
+	"notify_max_age", 7*24*time.Hour,
+	"How long to keep retrying queued notifications before giving up")
+
+// Notification policies, set per key in the notify_policy file.
+const (
+	// Notifications must be delivered before the key is released; if they
+	// fail, so does the request. This is the default.
+	notifyBeforeRelease = "before_release"
+
+	// Notifications are queued, and the key is released right away. They
+	// are delivered in the background, retrying as needed.
+	notifyEventually = "eventually"
+)
+
+// Backoff parameters for retrying queued notifications.
+const (
+	spoolMinBackoff = 30 * time.Second
+	spoolMaxBackoff = 1 * time.Hour
+
+	// How often we look at the spool even if nothing new was queued.
+	spoolScanInterval = 30 * time.Second
+)
+
+// Event types.
+const (
+	// A key was given to a client.
+	EventKeyGranted = "key_granted"
+
+	// A request for a key was denied.
+	EventKeyDenied = "key_denied"
+
+	// A source (IP address or client certificate) was banned, due to too
+	// many denied requests.
+	EventSourceBanned = "source_banned"
+)
+
+// Event is something we notify about, like an access to a key. It is the
+// common information used by all the notification mechanisms.
+type Event struct {
+	Type string
+	Time time.Time
+
+	// The key, and the request for it.
+	Key string
+	Req *Request
+
+	// The client certificate, and the chains that authorized it. For
+	// denials, the chain presented by the client.
+	Cert   *x509.Certificate
+	Chains [][]*x509.Certificate
+
+	// For denials, the reason, and how many other denials from the same
+	// source were not notified since the last notification.
+	Reason     string
+	Suppressed int
+
+	// For bans, the ban itself.
+	Ban *Ban
+
+	// The notifications sent (or queued) for the event, filled in by
+	// Notify.
+	Notified []notifyResult
+}
+
+// notifyResult is a notification performed by Notify.
+type notifyResult struct {
+	// Kind of notification ("email" or "webhook").
+	Kind string `json:"kind"`
+
+	// Whether it was queued to be delivered in the background, instead of
+	// delivered right away.
+	Queued bool `json:"queued"`
+}
+
+// NewEvent creates a new Event of the given type, for the request.
+func NewEvent(evType string, req *Request,
+	chains [][]*x509.Certificate) (*Event, error) {
+	keyPath, err := req.KeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{
+		Type:   evType,
+		Time:   time.Now(),
+		Key:    keyPath,
+		Req:    req,
+		Cert:   chains[0][0],
+		Chains: chains,
+	}, nil
+}
+
+// delivery is a single notification to deliver, e.g. an email to a set of
+// recipients. It is what gets stored in the spool.
+type delivery struct {
+	Kind string
+
+	// Email notifications.
+	From string   `json:",omitempty"`
+	To   []string `json:",omitempty"`
+
+	// Webhook notifications.
+	URL string `json:",omitempty"`
+
+	// The email message, or the webhook's payload.
+	Data []byte `json:",omitempty"`
+
+	// Spool bookkeeping.
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+}
+
+func (d *delivery) String() string {
+	if d.Kind == "webhook" {
+		return fmt.Sprintf("%s to %s", d.Kind, d.URL)
+	}
+	return fmt.Sprintf("%s to %s", d.Kind, strings.Join(d.To, ", "))
+}
+
+// deliver the notification, returning an error if it failed.
+func (d *delivery) deliver() error {
+	switch d.Kind {
+	case "email":
+		return sendMail(d.From, d.To, d.Data)
+	case "webhook":
+		return postWebhook(d.URL, d.Data)
+	default:
+		return fmt.Errorf("unknown notification kind %q", d.Kind)
+	}
+}
+
+// The global notification spool.
+var notifySpool *Spool
+
+// Notify sends the notifications for the event on the given key, following
+// the key's notification policy.
+func Notify(kc *KeyConfig, ev *Event) error {
+	policy, err := kc.NotifyPolicy()
+	if err != nil {
+		return err
+	}
+
+	ds, err := composeNotifications(kc, ev)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range ds {
+		if policy == notifyEventually {
+			ev.Req.Printf("Queueing notification: %s", d)
+			err = notifySpool.Add(d)
+		} else {
+			err = d.deliver()
+		}
+		if err != nil {
+			return err
+		}
+		ev.Notified = append(ev.Notified, notifyResult{
+			Kind:   d.Kind,
+			Queued: policy == notifyEventually,
+		})
+	}
+
+	return nil
+}
+
+// composeNotifications returns all the deliveries (webhooks and emails) for
+// the event on the given key.
+func composeNotifications(kc *KeyConfig, ev *Event) ([]*delivery, error) {
+	ds, err := composeWebhooks(kc, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := composeMail(kc, ev)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Spool is an on-disk queue of notifications, which are delivered in the
+// background, retrying with exponential backoff.
+//
+// Each notification is stored as a JSON file in the spool directory, named
+// after its creation time so they sort in order.
+type Spool struct {
+	dir string
+
+	// Function to deliver the notifications, can be overridden for
+	// testing.
+	deliver func(d *delivery) error
+
+	// Serializes the processing of the spool.
+	mu sync.Mutex
+
+	// Used to wake up the background loop when a new notification is
+	// added.
+	kick chan struct{}
+}
+
+// NewSpool returns a new Spool using the given directory, which will be
+// created if needed.
+func NewSpool(dir string) *Spool {
+	return &Spool{
+		dir:     dir,
+		deliver: (*delivery).deliver,
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// Add a notification to the spool, and wake up the background loop to
+// deliver it.
+func (s *Spool) Add(d *delivery) error {
+	d.Created = time.Now()
+	d.NextAttempt = d.Created
+
+	buf, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+	name := fmt.Sprintf("%d-%s.json",
+		d.Created.UnixNano(), hex.EncodeToString(rnd))
+	err = writeFileAtomic(filepath.Join(s.dir, name), buf)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run the background loop that delivers the queued notifications. It never
+// returns.
+func (s *Spool) Run() {
+	ticker := time.NewTicker(spoolScanInterval)
+	for {
+		s.Process()
+		select {
+		case <-s.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// list the files in the spool, oldest first.
+func (s *Spool) list() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		// The directory is created on the first Add, so it's normal for
+		// it to be missing.
+		if !os.IsNotExist(err) {
+			logging.Printf("Error reading spool: %v", err)
+		}
+		return nil
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".json") &&
+			!strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Process makes a delivery attempt for all the notifications that are due.
+func (s *Spool) Process() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, name := range s.list() {
+		path := filepath.Join(s.dir, name)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			logging.Printf("Spool: error reading %s: %v", name, err)
+			continue
+		}
+
+		d := &delivery{}
+		if err := json.Unmarshal(buf, d); err != nil {
+			logging.Printf("Spool: removing invalid %s: %v", name, err)
+			os.Remove(path)
+			continue
+		}
+
+		if now.Before(d.NextAttempt) {
+			continue
+		}
+
+		err = s.deliver(d)
+		d.Attempts++
+		if err == nil {
+			logging.Printf("Spool: delivered %s (%s, %d attempts)",
+				name, d, d.Attempts)
+			os.Remove(path)
+			continue
+		}
+
+		if now.Sub(d.Created) > *notifyMaxAge {
+			logging.Printf("Spool: giving up on %s (%s) after %d "+
+				"attempts: %v", name, d, d.Attempts, err)
+			os.Remove(path)
+			continue
+		}
+
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(spoolBackoff(d.Attempts))
+		logging.Printf("Spool: error delivering %s (%s), will retry "+
+			"at %s: %v", name, d, d.NextAttempt.Format(time.Stamp), err)
+
+		buf, _ = json.Marshal(d)
+		if err := writeFileAtomic(path, buf); err != nil {
+			logging.Printf("Spool: error updating %s: %v", name, err)
+		}
+	}
+}
+
+// spoolBackoff returns how long to wait before the next delivery attempt,
+// after the given number of failed ones.
+func spoolBackoff(attempts int) time.Duration {
+	backoff := spoolMinBackoff
+	for i := 1; i < attempts && backoff < spoolMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > spoolMaxBackoff {
+		backoff = spoolMaxBackoff
+	}
+	return backoff
+}
+
+// Stats returns the number of notifications in the spool, and the age of
+// the oldest one.
+func (s *Spool) Stats() (depth int, oldest time.Duration) {
+	names := s.list()
+	if len(names) == 0 {
+		return 0, 0
+	}
+
+	// The names begin with the creation time, so we don't need to open the
+	// files.
+	nanos, _, _ := strings.Cut(names[0], "-")
+	created, err := strconv.ParseInt(nanos, 10, 64)
+	if err == nil {
+		oldest = time.Since(time.Unix(0, created))
+	}
+	return len(names), oldest
+}
+
+// Export the spool statistics for monitoring.
+func init() {
+	stats := func() (int, time.Duration) {
+		if notifySpool == nil {
+			return 0, 0
+		}
+		return notifySpool.Stats()
+	}
+
+	expvar.Publish("notify_queue_depth", expvar.Func(func() interface{} {
+		depth, _ := stats()
+		return depth
+	}))
+	expvar.Publish("notify_queue_oldest_seconds", expvar.Func(
+		func() interface{} {
+			_, oldest := stats()
+			return int64(oldest.Seconds())
+		}))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	s := NewSpool(t.TempDir() + "/spool")
+
+	// An empty (and not yet created) spool.
+	s.Process()
+	if depth, oldest := s.Stats(); depth != 0 || oldest != 0 {
+		t.Errorf("empty spool stats: %d, %v", depth, oldest)
+	}
+
+	delivered := []string{}
+	fail := true
+	s.deliver = func(d *delivery) error {
+		if fail {
+			return errors.New("relay down")
+		}
+		delivered = append(delivered, string(d.Data))
+		return nil
+	}
+
+	for _, data := range []string{"msg1", "msg2"} {
+		err := s.Add(&delivery{Kind: "email", Data: []byte(data)})
+		if err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	// First attempt fails, they should be kept in the spool.
+	s.Process()
+	if depth, oldest := s.Stats(); depth != 2 || oldest <= 0 {
+		t.Errorf("spool stats after failure: %d, %v", depth, oldest)
+	}
+
+	// Retrying right away should not do anything, due to the backoff.
+	fail = false
+	s.Process()
+	if len(delivered) != 0 {
+		t.Errorf("delivered before backoff expired: %v", delivered)
+	}
+
+	// Pretend the backoff expired.
+	for _, name := range s.list() {
+		writeDeliveryDue(t, s, name)
+	}
+	s.Process()
+	if len(delivered) != 2 || delivered[0] != "msg1" ||
+		delivered[1] != "msg2" {
+		t.Errorf("unexpected deliveries: %v", delivered)
+	}
+	if depth, _ := s.Stats(); depth != 0 {
+		t.Errorf("spool not empty after delivery: %d", depth)
+	}
+}
+
+func TestSpoolGiveUp(t *testing.T) {
+	s := NewSpool(t.TempDir())
+	s.deliver = func(d *delivery) error {
+		return errors.New("relay down")
+	}
+
+	maxAge := *notifyMaxAge
+	*notifyMaxAge = 0
+	defer func() { *notifyMaxAge = maxAge }()
+
+	s.Add(&delivery{Kind: "email"})
+	time.Sleep(time.Millisecond)
+	s.Process()
+	if depth, _ := s.Stats(); depth != 0 {
+		t.Errorf("expired notification was kept: %d", depth)
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, 1 * time.Minute},
+		{3, 2 * time.Minute},
+		{8, 60 * time.Minute},
+		{100, 60 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := spoolBackoff(c.attempts); got != c.want {
+			t.Errorf("spoolBackoff(%d) = %v, want %v",
+				c.attempts, got, c.want)
+		}
+	}
+}
+
+// writeDeliveryDue changes the given spooled notification so it's due for
+// delivery now.
+func writeDeliveryDue(t *testing.T, s *Spool, name string) {
+	t.Helper()
+	path := filepath.Join(s.dir, name)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &delivery{}
+	if err := json.Unmarshal(buf, d); err != nil {
+		t.Fatal(err)
+	}
+	d.NextAttempt = time.Now().Add(-1 * time.Second)
+	buf, _ = json.Marshal(d)
+	if err := writeFileAtomic(path, buf); err != nil {
+		t.Fatal(err)
+	}
+}
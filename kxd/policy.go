@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+var inheritAllowedClients = flag.Bool(
+	"inherit_allowed_clients", false,
+	"Let keys inherit allowed_clients from their parent directories")
+
+// Policy files, which keys inherit from their parent directories (and the
+// root of the store) if they don't have their own.
+//
+// The closest one wins, so a key can override the inherited policy with its
+// own file. To stop inheriting, put a "no_inherit" file in the key's
+// directory (or in one of its parents): if empty, nothing is inherited from
+// above that directory; otherwise it contains the names of the files not to
+// inherit.
+//
+// allowed_clients is only inherited with --inherit_allowed_clients: before
+// inheritance, a key without its own could not be accessed at all, and
+// existing trees should not silently start allowing clients on upgrade.
+var policyFiles = []string{
+	"allowed_clients",
+	"allowed_hosts",
+	"bind_client_ip",
+	"email_to",
+	"notify_policy",
+	"webhooks",
+	"limits",
+	"schedule",
+	"labels",
+}
+
+// inherits returns whether the file with the given name is inherited from
+// the parent directories.
+func inherits(name string) bool {
+	if name == "allowed_clients" && !*inheritAllowedClients {
+		return false
+	}
+	for _, p := range policyFiles {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parentKeyPath returns the path of the parent of the given key or
+// directory, "" being the root.
+func parentKeyPath(keyPath string) string {
+	parent := path.Dir(keyPath)
+	if parent == "." || parent == "/" {
+		return ""
+	}
+	return parent
+}
+
+// stopsInheriting returns whether the given directory stops inheriting the
+// file with the given name from its parents.
+func stopsInheriting(store Store, dir, name string) (bool, error) {
+	contents, err := store.ReadFile(dir, "no_inherit")
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	names := strings.Fields(string(contents))
+	if len(names) == 0 {
+		return true, nil
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookupFile finds the key's configuration file with the given name. Policy
+// files are inherited: if the key doesn't have it, it is looked up in the
+// parents, until one has it, or one stops inheriting it (see policyFiles and
+// inherits).
+//
+// It returns the contents, and the path of the key or directory it came
+// from ("" being the root). If no file is found, the error satisfies
+// os.IsNotExist.
+func lookupFile(store Store, keyPath, name string) ([]byte, string, error) {
+	dir := keyPath
+	for {
+		contents, err := store.ReadFile(dir, name)
+		if err == nil {
+			return contents, dir, nil
+		} else if !os.IsNotExist(err) {
+			return nil, dir, err
+		}
+
+		if !inherits(name) || dir == "" {
+			break
+		}
+		stop, err := stopsInheriting(store, dir, name)
+		if err != nil {
+			return nil, dir, err
+		}
+		if stop {
+			break
+		}
+		dir = parentKeyPath(dir)
+	}
+
+	return nil, "", &fs.PathError{
+		Op:   "read",
+		Path: strings.TrimPrefix(keyPath+"/"+name, "/"),
+		Err:  fs.ErrNotExist,
+	}
+}
+
+// originString returns a human-readable description of where a policy file
+// came from, given the key and the path returned by lookupFile.
+func originString(keyPath, origin string) string {
+	switch origin {
+	case keyPath:
+		return "own"
+	case "":
+		return "inherited from the root"
+	default:
+		return "inherited from " + origin + "/"
+	}
+}
+
+// checkKey loads the key's policy, and returns the problems found. It
+// doesn't read the key itself, nor resolve the allowed hosts.
+func checkKey(kc *KeyConfig) []error {
+	errs := []error{}
+	add := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	add("allowed_clients", kc.LoadClientCerts())
+	_, err := kc.BindClientIP()
+	add("bind_client_ip", err)
+	_, err = kc.EmailTo()
+	add("email_to", err)
+	_, err = kc.Webhooks()
+	add("webhooks", err)
+	_, err = kc.NotifyPolicy()
+	add("notify_policy", err)
+	_, err = kc.Limits()
+	add("limits", err)
+	_, err = kc.Schedule()
+	add("schedule", err)
+	_, err = kc.Labels()
+	add("labels", err)
+	return errs
+}
+
+// cmdCheck checks the configuration of the given keys (or all of them), and
+// shows the effective policy files of each.
+func cmdCheck(args []string) error {
+	store := NewDirStore(*dataDir)
+
+	keys := []string{}
+	for _, arg := range args {
+		keyPath, err := cleanKeyPath(arg)
+		if err != nil {
+			return err
+		}
+		if exists, err := store.HasKey(keyPath); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("key %q not found in %s", keyPath, store)
+		}
+		keys = append(keys, keyPath)
+	}
+	if len(args) == 0 {
+		var err error
+		keys, err = store.Keys()
+		if err != nil {
+			return err
+		}
+	}
+
+	nErrors := 0
+	for _, keyPath := range keys {
+		kc := NewKeyConfig(store, keyPath)
+		errs := checkKey(kc)
+		if len(errs) == 0 {
+			fmt.Printf("%s: ok\n", keyPath)
+		} else {
+			fmt.Printf("%s: %d errors\n", keyPath, len(errs))
+		}
+
+		for _, name := range policyFiles {
+			_, origin, err := lookupFile(store, keyPath, name)
+			if err == nil {
+				fmt.Printf("    %-16s %s\n", name,
+					originString(keyPath, origin))
+			} else if name == "allowed_clients" {
+				fmt.Printf("    %-16s %s\n", name,
+					"missing, no clients are allowed")
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("    error: %v\n", err)
+		}
+		nErrors += len(errs)
+	}
+
+	if nErrors > 0 {
+		return fmt.Errorf("found %d errors", nErrors)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPolicyInheritance(t *testing.T) {
+	s := NewMemStore()
+	set := func(keyPath, name, contents string) {
+		s.Set(keyPath, name, []byte(contents))
+	}
+	set("", "email_to", "root@example.com")
+	set("", "limits", "total 10")
+	set("host", "allowed_clients", "clients")
+	set("host", "allowed_hosts", "host")
+	set("host", "email_to", "host@example.com")
+	set("host/d1", "key", "d1")
+	set("host/d2", "key", "d2")
+	set("host/d2", "allowed_hosts", "d2")
+	set("host/d3", "key", "d3")
+	set("host/d3", "no_inherit", "")
+	set("host/d4", "key", "d4")
+	set("host/d4", "no_inherit", "limits\n")
+	set("host/d4", "email.tmpl", "template")
+
+	cases := []struct {
+		key, name, contents, origin string
+	}{
+		// Inherited from the closest parent.
+		{"host/d1", "allowed_hosts", "host", "host"},
+		{"host/d1", "email_to", "host@example.com", "host"},
+		{"host/d1", "limits", "total 10", ""},
+
+		// Overridden by the key.
+		{"host/d2", "allowed_hosts", "d2", "host/d2"},
+		{"host/d2", "email_to", "host@example.com", "host"},
+
+		// Not inherited at all.
+		{"host/d3", "allowed_hosts", "", ""},
+		{"host/d3", "limits", "", ""},
+
+		// Only some files are not inherited.
+		{"host/d4", "allowed_hosts", "host", "host"},
+		{"host/d4", "limits", "", ""},
+
+		// Only policy files are inherited.
+		{"host/d1", "email.tmpl", "", ""},
+		{"host/d1", "key", "d1", "host/d1"},
+		{"host/d1", "no_inherit", "", ""},
+
+		// allowed_clients is not inherited by default.
+		{"host/d1", "allowed_clients", "", ""},
+	}
+	for _, c := range cases {
+		contents, origin, err := lookupFile(s, c.key, c.name)
+		if c.contents == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s %s: expected not found, got %q, %v",
+					c.key, c.name, contents, err)
+			}
+			continue
+		}
+		if string(contents) != c.contents || origin != c.origin ||
+			err != nil {
+			t.Errorf("%s %s: got %q from %q, %v; expected %q from %q",
+				c.key, c.name, contents, origin, err,
+				c.contents, c.origin)
+		}
+	}
+
+	setFlag(t, inheritAllowedClients, true)
+	contents, origin, err := lookupFile(s, "host/d1", "allowed_clients")
+	if string(contents) != "clients" || origin != "host" || err != nil {
+		t.Errorf("allowed_clients with --inherit_allowed_clients: "+
+			"got %q from %q, %v", contents, origin, err)
+	}
+
+	// The key configuration uses the inherited files.
+	emails, err := NewKeyConfig(s, "host/d1").EmailTo()
+	if len(emails) != 1 || emails[0] != "host@example.com" || err != nil {
+		t.Errorf("EmailTo = %v, %v", emails, err)
+	}
+
+	origins := map[string]string{
+		"host/d1": "own",
+		"host":    "inherited from host/",
+		"":        "inherited from the root",
+	}
+	for origin, expected := range origins {
+		if s := originString("host/d1", origin); s != expected {
+			t.Errorf("originString(%q) = %q, expected %q",
+				origin, s, expected)
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	s := NewMemStore()
+	s.Set("", "limits", []byte("total x"))
+	s.Set("ok", "key", []byte("ok"))
+	s.Set("ok", "no_inherit", []byte(""))
+	s.Set("bad", "key", []byte("bad"))
+	s.Set("bad", "schedule", []byte("window"))
+
+	if errs := checkKey(NewKeyConfig(s, "ok")); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if errs := checkKey(NewKeyConfig(s, "bad")); len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+}
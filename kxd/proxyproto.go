@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var trustedProxies stringList
+
+func init() {
+	flag.Var(&trustedProxies, "trusted_proxy",
+		"Address or network (in CIDR notation) of a proxy that uses the "+
+			"PROXY protocol to tell us the clients' addresses "+
+			"(can be repeated)")
+}
+
+// Timeout for reading the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// Support for the PROXY protocol (versions 1 and 2), as specified in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+//
+// It lets kxd run behind TCP proxies and load balancers (like HAProxy), and
+// still know the address of the clients. TLS still terminates at kxd, so
+// client certificates keep working.
+//
+// Connections from the trusted proxies must begin with the PROXY header,
+// and then the address in it is used as the remote address of the
+// connection (for authorization, logging, hooks, etc.). Connections from
+// anywhere else are left as they are, so a header from them is just an
+// invalid TLS handshake.
+
+// parseTrustedProxies parses the --trusted_proxy values, which can be
+// addresses or networks.
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+		} else {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes,
+				netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// proxyListener wraps a listener, to handle the PROXY protocol headers of
+// connections from trusted proxies.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+func newProxyListener(l net.Listener, trusted []netip.Prefix) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, p := range l.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept waits for the next connection. It doesn't read the PROXY header, so
+// a slow proxy doesn't hold up the other connections: that is done by the
+// connection itself, on the first Read or RemoteAddr call, which happen in
+// the connection's own goroutine.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection from a trusted proxy, which begins with the
+// PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+
+	// Reads go through the buffered reader, as it may have read past the
+	// header.
+	br *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			logging.Printf("%s: invalid PROXY header: %v",
+				c.Conn.RemoteAddr(), c.err)
+		}
+		if c.remoteAddr == nil {
+			// Either an error, or a header without the client
+			// address (e.g. for the proxy's own health checks).
+			c.remoteAddr = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the address of the client, as given by the proxy.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Maximum length of a version 1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// readProxyHeader reads a PROXY protocol header (version 1 or 2), and
+// returns the source address in it. The address is nil if the header
+// doesn't have one (for "UNKNOWN" and "LOCAL" connections). Version 2
+// headers for protocols other than TCP are an error.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	start, err := br.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+
+	start, err = br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+
+	return nil, errors.New("no PROXY header found")
+}
+
+// readProxyV1 reads a version 1 (text) header, like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("v1 header too long")
+		}
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source address: %v", err)
+	}
+	if addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("v1 source address %s is not %s",
+			addr, fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port: %v", err)
+	}
+
+	return net.TCPAddrFromAddrPort(
+		netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 reads a version 2 (binary) header.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	// Signature (12 bytes), version and command (1), address family and
+	// protocol (1), and the length of the rest (2).
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, famProto := hdr[12], hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:])
+
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: the connection was made by the proxy itself.
+		return nil, nil
+	case 1:
+		// PROXY.
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", verCmd&0xf)
+	}
+
+	var ip []byte
+	var port []byte
+	switch famProto {
+	case 0x11:
+		// TCP over IPv4: source and destination addresses (4 bytes
+		// each), then ports (2 bytes each).
+		if len(rest) < 12 {
+			return nil, errors.New("v2 header too short for TCP4")
+		}
+		ip, port = rest[0:4], rest[8:10]
+	case 0x21:
+		// TCP over IPv6: like above, with 16 byte addresses.
+		if len(rest) < 36 {
+			return nil, errors.New("v2 header too short for TCP6")
+		}
+		ip, port = rest[0:16], rest[32:34]
+	default:
+		// Other protocols (e.g. UDP or unix sockets) don't give us a
+		// client address we can use, and the proxy's would stand in for
+		// every client behind it, so they are rejected.
+		return nil, fmt.Errorf("unsupported v2 address family and "+
+			"protocol 0x%02x", famProto)
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(
+		addr, binary.BigEndian.Uint16(port))), nil
+}
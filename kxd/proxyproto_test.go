@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies(
+		[]string{"192.0.2.1", "198.51.100.7/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	for _, v := range []string{"", "host", "192.0.2.1/33", "192.0.2/24"} {
+		if _, err := parseTrustedProxies([]string{v}); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", v)
+		}
+	}
+}
+
+// proxyV2 builds a version 2 header, with the given command, family and
+// protocol, and addresses.
+func proxyV2(cmd, famProto byte, addrs []byte) string {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, famProto)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x12, 0x34, 0x01, 0xbb}
+	v6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(),
+		netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	v6 = append(v6, 0x12, 0x34, 0x01, 0xbb)
+
+	cases := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660 443\r\n",
+			"192.0.2.1:4660", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4660 443\r\n",
+			"[2001:db8::1]:4660", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{proxyV2(1, 0x11, v4), "192.0.2.1:4660", false},
+		{proxyV2(1, 0x21, v6), "[2001:db8::1]:4660", false},
+		{proxyV2(1, 0x11, append(v4, 0x04, 0x00, 0x01, 'x')),
+			"192.0.2.1:4660", false},
+		{proxyV2(0, 0x00, nil), "", false},
+		{proxyV2(0, 0x31, []byte("unix sockets")), "", false},
+
+		{"", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 192.0.2.2 4660 443\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", "", true},
+		{"PROXY TCP5 192.0.2.1 192.0.2.2 4660 443\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 4660 443", "", true},
+		{proxyV2(2, 0x11, v4), "", true},
+		{proxyV2(1, 0x11, v4[:8]), "", true},
+		{proxyV2(1, 0x21, v4), "", true},
+		{proxyV2(1, 0x00, nil), "", true},
+		{proxyV2(1, 0x12, v4), "", true},
+		{proxyV2(1, 0x31, []byte("unix sockets")), "", true},
+		{proxyV2(1, 0x11, v4)[:20], "", true},
+	}
+
+	for _, c := range cases {
+		br := bufio.NewReader(strings.NewReader(c.header + "rest"))
+		addr, err := readProxyHeader(br)
+		if (err != nil) != c.err {
+			t.Errorf("%q: unexpected error: %v", c.header, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.addr {
+			t.Errorf("%q: got %q, want %q", c.header, got, c.addr)
+		}
+
+		// The data after the header must be left as it is.
+		if rest, _ := io.ReadAll(br); string(rest) != "rest" {
+			t.Errorf("%q: left %q after the header", c.header, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	// Connects to a proxy listener trusting the given network, sending the
+	// header; checks that the remote address is the expected one ("" for
+	// the connection's own).
+	try := func(trusted, header, want string) {
+		t.Helper()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		prefixes, _ := parseTrustedProxies([]string{trusted})
+		pl := newProxyListener(l, prefixes)
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte(header + "data"))
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if want == "" {
+			// The connection's own address.
+			want = client.LocalAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("RemoteAddr = %q, want %q", got, want)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil ||
+			string(buf) != "data" {
+			t.Errorf("read %q, %v", buf, err)
+		}
+	}
+
+	header := "PROXY TCP4 192.0.2.1 127.0.0.1 4660 443\r\n"
+
+	// From a trusted proxy, the address in the header is used.
+	try("127.0.0.0/8", header, "192.0.2.1:4660")
+
+	// Otherwise the connection is left alone.
+	try("192.0.2.0/24", "", "")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Replies to key requests depend on the version of the protocol used.
+//
+// Version 1 ("/v1/") replies with the raw key, and errors are plain text.
+//
+// Version 2 ("/v2/") replies with a JSON object (v2Reply) in all cases,
+// which has more information about the key and the request, and errors with
+// stable codes, so clients can tell them apart reliably.
+
+// errorCode identifies the reason for an error reply. The names are part of
+// the protocol, so they must not change.
+type errorCode struct {
+	name   string
+	status int
+}
+
+var (
+	errCodeInternal = errorCode{"internal_error",
+		http.StatusInternalServerError}
+	errCodeBanned = errorCode{"banned",
+		http.StatusTooManyRequests}
+	errCodeNoCert = errorCode{"no_client_cert",
+		http.StatusNotAcceptable}
+	errCodeInvalidPath = errorCode{"invalid_key_path",
+		http.StatusNotAcceptable}
+	errCodeUnknownKey = errorCode{"unknown_key",
+		http.StatusNotFound}
+	errCodeLocked = errorCode{"locked",
+		http.StatusLocked}
+	errCodeHostNotAllowed = errorCode{"host_not_allowed",
+		http.StatusForbidden}
+	errCodeIPNotBound = errorCode{"client_ip_mismatch",
+		http.StatusForbidden}
+	errCodeClientNotAllowed = errorCode{"client_not_allowed",
+		http.StatusForbidden}
+	errCodeOutsideSchedule = errorCode{"outside_schedule",
+		http.StatusForbidden}
+	errCodeHookDenied = errorCode{"denied_by_hook",
+		http.StatusForbidden}
+	errCodeAuthorizerDenied = errorCode{"denied_by_authorizer",
+		http.StatusForbidden}
+	errCodeRateLimited = errorCode{"rate_limited",
+		http.StatusTooManyRequests}
+	errCodeUsesExhausted = errorCode{"uses_exhausted",
+		http.StatusGone}
+	errCodeNotifyFailed = errorCode{"notification_failed",
+		http.StatusInternalServerError}
+)
+
+// v2Reply is the reply to version 2 requests.
+type v2Reply struct {
+	RequestID  string    `json:"request_id"`
+	ServerTime time.Time `json:"server_time"`
+
+	// For key requests: the key (base64-encoded, as encoding/json does for
+	// []byte), its version if it has one (only derived keys do), and the
+	// notifications performed for the access.
+	Key           []byte         `json:"key,omitempty"`
+	KeyVersion    int            `json:"key_version,omitempty"`
+	Notifications []notifyResult `json:"notifications,omitempty"`
+
+	// If signing is enabled, the key's signature (see signedMessage),
+	// and its time in seconds since the epoch.
+	Signature     []byte `json:"signature,omitempty"`
+	SignatureTime int64  `json:"signature_time,omitempty"`
+
+	// For metadata requests, the key's metadata.
+	Meta *keyMeta `json:"meta,omitempty"`
+
+	Error *v2Error `json:"error,omitempty"`
+}
+
+type v2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeV2Reply(w http.ResponseWriter, req *Request, status int,
+	reply *v2Reply) {
+	reply.RequestID = req.ID
+	reply.ServerTime = time.Now()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// replyError replies to the request with the given error. The message is
+// meant for humans, and must not include internal details.
+func replyError(w http.ResponseWriter, req *Request, code errorCode,
+	msg string) {
+	if req.APIVersion() == 1 {
+		http.Error(w, msg, code.status)
+		return
+	}
+
+	writeV2Reply(w, req, code.status, &v2Reply{
+		Error: &v2Error{Code: code.name, Message: msg},
+	})
+}
+
+// replyKey replies to the request with the given version of the key,
+// signed if enabled (see --signing_key). The event is the one for the key
+// being granted.
+//
+// The caller wipes the key afterwards, but note the copies made by the
+// encoding/json and net/http buffers are out of our reach.
+func replyKey(w http.ResponseWriter, req *Request, keyData []byte,
+	version int, ev *Event) {
+	var sig []byte
+	ts := ev.Time.Unix()
+	if signingKey != nil {
+		sig = ed25519.Sign(signingKey, signedMessage(ev.Key, version,
+			certFingerprint(ev.Cert), ts, keyData))
+	}
+
+	if req.APIVersion() == 1 {
+		if sig != nil {
+			h := w.Header()
+			h.Set("X-Kxd-Key-Signature",
+				base64.StdEncoding.EncodeToString(sig))
+			h.Set("X-Kxd-Key-Signature-Time", strconv.FormatInt(ts, 10))
+			h.Set("X-Kxd-Key-Version", strconv.Itoa(version))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(keyData)
+		return
+	}
+
+	reply := &v2Reply{
+		Key:           keyData,
+		KeyVersion:    version,
+		Notifications: ev.Notified,
+		Signature:     sig,
+	}
+	if sig != nil {
+		reply.SignatureTime = ts
+	}
+	writeV2Reply(w, req, http.StatusOK, reply)
+}
+
+// replyMeta replies to the request with the key's metadata.
+func replyMeta(w http.ResponseWriter, req *Request, meta *keyMeta) {
+	if req.APIVersion() == 1 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(meta)
+		return
+	}
+
+	writeV2Reply(w, req, http.StatusOK, &v2Reply{Meta: meta})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	cases := []struct {
+		url  string
+		want int
+	}{
+		{"/v1/key", 1},
+		{"/v2/key", 2},
+		{"/v2/path/to/key", 2},
+		{"/v3/key", 1},
+		{"/", 1},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		req := &Request{Request: &http.Request{URL: u}}
+		if got := req.APIVersion(); got != c.want {
+			t.Errorf("%q APIVersion == %d, want %d", c.url, got, c.want)
+		}
+	}
+}
+
+func TestV2Replies(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+	stub := &webhookStub{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	s := NewMemStore()
+	s.Set("host/key", "key", []byte("sekrit"))
+	s.Set("host/key", "allowed_clients", []byte(certPEM(cert)))
+	s.Set("host/key", "limits", []byte("single_use\n"))
+	s.Set("host/key", "webhooks", []byte(srv.URL+"\n"))
+
+	oldStore, oldLockdown, oldLimits, oldTracker, oldSpool :=
+		keyStore, lockdown, limitTracker, accessTracker, notifySpool
+	keyStore = s
+	lockdown = NewLockdown(t.TempDir())
+	limitTracker = NewLimitTracker(t.TempDir())
+	accessTracker = NewAccessTracker(t.TempDir())
+	notifySpool = NewSpool(t.TempDir())
+	defer func() {
+		keyStore, lockdown, limitTracker, accessTracker, notifySpool =
+			oldStore, oldLockdown, oldLimits, oldTracker, oldSpool
+	}()
+
+	get := func(rawURL string, status int) *v2Reply {
+		t.Helper()
+		u, _ := url.Parse(rawURL)
+		req := &http.Request{
+			URL:        u,
+			RemoteAddr: "192.0.2.1:1234",
+			TLS: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		if w.Code != status {
+			t.Errorf("%s: got %d, expected %d", rawURL, w.Code, status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: unexpected content type %q", rawURL, ct)
+		}
+		reply := &v2Reply{}
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", rawURL, w.Body, err)
+		}
+		if reply.RequestID == "" || reply.ServerTime.IsZero() {
+			t.Errorf("%s: missing request ID or time: %+v", rawURL,
+				reply)
+		}
+		return reply
+	}
+
+	reply := get("/v2/host/key?meta", http.StatusOK)
+	if reply.Meta == nil || reply.Meta.Key != "host/key" ||
+		reply.Key != nil {
+		t.Errorf("unexpected metadata reply: %+v", reply)
+	}
+
+	reply = get("/v2/host/key", http.StatusOK)
+	notified := []notifyResult{{Kind: "webhook", Queued: false}}
+	if string(reply.Key) != "sekrit" || reply.Error != nil ||
+		!reflect.DeepEqual(reply.Notifications, notified) {
+		t.Errorf("unexpected key reply: %+v", reply)
+	}
+
+	reply = get("/v2/host/key", http.StatusGone)
+	if reply.Key != nil || reply.Error == nil ||
+		reply.Error.Code != "uses_exhausted" {
+		t.Errorf("unexpected reply over the limits: %+v", reply)
+	}
+
+	reply = get("/v2/host/nokey", http.StatusNotFound)
+	if reply.Error == nil || reply.Error.Code != "unknown_key" ||
+		reply.Error.Message != "Unknown key" {
+		t.Errorf("unexpected reply for unknown key: %+v", reply)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule restricts when a key can be accessed, from its schedule file.
+type Schedule struct {
+	// Timezone for the dates and windows.
+	Location *time.Location
+
+	// Absolute limits, zero if not set.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Windows in which the key can be accessed. If empty, it can be
+	// accessed at any time (within the absolute limits).
+	Windows []*window
+}
+
+// window is a weekly access window, like "mon-fri 02:00-04:00".
+type window struct {
+	// Days in which the window starts, indexed by time.Weekday.
+	days [7]bool
+
+	// Start and end, in minutes since midnight. If end <= start, the window
+	// goes past midnight into the next day.
+	start, end int
+
+	// The window as written in the schedule file.
+	spec string
+}
+
+func (w *window) String() string {
+	return w.spec
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseDays parses a list of days like "mon-fri,sun". "*" means every day.
+func parseDays(s string) ([7]bool, error) {
+	days := [7]bool{}
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("invalid days %q", s)
+		}
+
+		// Ranges can wrap around the end of the week (e.g. "fri-mon").
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of the day like "02:30", returning the minutes
+// since midnight. "24:00" is allowed, to mean the end of the day.
+func parseClock(s string) (int, error) {
+	hs, ms, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hs)
+	m, err2 := strconv.Atoi(ms)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 ||
+		h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseWindow(days, times string) (*window, error) {
+	w := &window{spec: days + " " + times}
+
+	var err error
+	w.days, err = parseDays(days)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time range %q", times)
+	}
+	if w.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parseDate parses a date for not_before/not_after. If it doesn't include
+// the time, it's the start of the day, or the end of it if endOfDay is true.
+func parseDate(s string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q", s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// parseSchedule parses the contents of a schedule file, which has one
+// setting per line:
+//
+//	timezone <name>               e.g. "Europe/London" (default: local)
+//	not_before <date>             e.g. "2024-01-31" or "2024-01-31T10:00"
+//	not_after <date>              (dates without time include the whole day)
+//	window <days> <start>-<end>   e.g. "mon-fri 02:00-04:00", "* 22:00-01:00"
+func parseSchedule(contents string) (*Schedule, error) {
+	s := &Schedule{Location: time.Local}
+
+	lines := [][]string{}
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+
+	// The timezone affects the other lines, so we need it first.
+	for _, fields := range lines {
+		if fields[0] == "timezone" && len(fields) == 2 {
+			loc, err := time.LoadLocation(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			s.Location = loc
+		}
+	}
+
+	for _, fields := range lines {
+		var err error
+		switch {
+		case fields[0] == "timezone" && len(fields) == 2:
+			// Already handled above.
+		case fields[0] == "not_before" && len(fields) == 2:
+			s.NotBefore, err = parseDate(fields[1], s.Location, false)
+		case fields[0] == "not_after" && len(fields) == 2:
+			s.NotAfter, err = parseDate(fields[1], s.Location, true)
+		case fields[0] == "window" && len(fields) == 3:
+			var w *window
+			w, err = parseWindow(fields[1], fields[2])
+			s.Windows = append(s.Windows, w)
+		default:
+			err = fmt.Errorf("invalid line %q", strings.Join(fields, " "))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// bounds returns the start and end of the window's occurrence that begins
+// on the same day as t.
+func (w *window) bounds(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, w.start, 0, 0, t.Location())
+	end := time.Date(y, m, d, 0, w.end, 0, 0, t.Location())
+	if w.end <= w.start {
+		end = time.Date(y, m, d+1, 0, w.end, 0, 0, t.Location())
+	}
+	return start, end
+}
+
+// contains returns whether the given time is within the window.
+func (w *window) contains(t time.Time) bool {
+	// The occurrence that began on the previous day may still be open.
+	for _, day := range []time.Time{t, t.AddDate(0, 0, -1)} {
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start, end := w.bounds(day)
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveWindow returns the window the given time falls in, or nil if there
+// is none.
+func (s *Schedule) ActiveWindow(t time.Time) *window {
+	t = t.In(s.Location)
+	for _, w := range s.Windows {
+		if w.contains(t) {
+			return w
+		}
+	}
+	return nil
+}
+
+// Check if the key can be accessed at the given time. If not, the error
+// explains why.
+func (s *Schedule) Check(t time.Time) error {
+	t = t.In(s.Location)
+	now := t.Format("Mon 2006-01-02 15:04 MST")
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		return fmt.Errorf("it is %s, not before %s", now,
+			s.NotBefore.In(s.Location).Format(time.RFC3339))
+	}
+	if !s.NotAfter.IsZero() && t.After(s.NotAfter) {
+		return fmt.Errorf("it is %s, not after %s", now,
+			s.NotAfter.In(s.Location).Format(time.RFC3339))
+	}
+	if len(s.Windows) > 0 && s.ActiveWindow(t) == nil {
+		return fmt.Errorf("it is %s, outside of the windows (%s)", now,
+			s.WindowsString())
+	}
+	return nil
+}
+
+// WindowsString returns the windows as a human-readable string.
+func (s *Schedule) WindowsString() string {
+	specs := []string{}
+	for _, w := range s.Windows {
+		specs = append(specs, w.spec)
+	}
+	return strings.Join(specs, ", ") + " " + s.Location.String()
+}
+
+// NextOpen returns the next time after t in which the key can be accessed.
+// The second value is false if there is none (e.g. it is past not_after).
+func (s *Schedule) NextOpen(t time.Time) (time.Time, bool) {
+	t = t.In(s.Location)
+	if !s.NotBefore.IsZero() && t.Before(s.NotBefore) {
+		t = s.NotBefore.In(s.Location)
+	}
+
+	next := t
+	if len(s.Windows) > 0 && s.ActiveWindow(t) == nil {
+		found := false
+		for i := 0; i <= 7; i++ {
+			day := t.AddDate(0, 0, i)
+			for _, w := range s.Windows {
+				if !w.days[day.Weekday()] {
+					continue
+				}
+				start, _ := w.bounds(day)
+				if start.After(t) && (!found || start.Before(next)) {
+					next = start
+					found = true
+				}
+			}
+		}
+		if !found {
+			return time.Time{}, false
+		}
+	}
+
+	if !s.NotAfter.IsZero() && next.After(s.NotAfter) {
+		return time.Time{}, false
+	}
+	return next, true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	s, err := parseSchedule(`
+		# Maintenance windows.
+		timezone America/New_York
+		not_before 2024-01-10
+		not_after 2024-12-31
+		window mon-fri 02:00-04:00
+		window sat,sun 23:00-01:00
+	`)
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	at := func(date, clock string) time.Time {
+		t.Helper()
+		ts, err := time.ParseInLocation(
+			"2006-01-02 15:04", date+" "+clock, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	cases := []struct {
+		t       time.Time
+		allowed bool
+	}{
+		// 2024-01-15 is a Monday.
+		{at("2024-01-15", "02:00"), true},
+		{at("2024-01-15", "03:59"), true},
+		{at("2024-01-15", "04:00"), false},
+		{at("2024-01-15", "01:59"), false},
+		{at("2024-01-15", "12:00"), false},
+
+		// Same time in a different timezone.
+		{at("2024-01-15", "03:00").UTC(), true},
+
+		// Windows crossing midnight: Saturday 23:00 to Sunday 01:00, and
+		// Sunday 23:00 to Monday 01:00.
+		{at("2024-01-13", "22:59"), false},
+		{at("2024-01-13", "23:30"), true},
+		{at("2024-01-14", "00:30"), true},
+		{at("2024-01-14", "01:00"), false},
+		{at("2024-01-15", "00:30"), true},
+		{at("2024-01-16", "00:30"), false},
+
+		// Absolute limits, which include the whole day of not_after.
+		{at("2024-01-09", "02:30"), false},
+		{at("2024-12-31", "02:30"), true},
+		{at("2025-01-01", "02:30"), false},
+	}
+	for _, c := range cases {
+		err := s.Check(c.t)
+		if (err == nil) != c.allowed {
+			t.Errorf("%v: expected allowed=%v, got error %v",
+				c.t, c.allowed, err)
+		}
+	}
+
+	nextCases := []struct {
+		t, next time.Time
+		ok      bool
+	}{
+		{at("2024-01-15", "03:00"), at("2024-01-15", "03:00"), true},
+		{at("2024-01-15", "12:00"), at("2024-01-16", "02:00"), true},
+		{at("2024-01-12", "12:00"), at("2024-01-13", "23:00"), true},
+		{at("2024-01-01", "12:00"), at("2024-01-10", "02:00"), true},
+		{at("2024-12-31", "12:00"), time.Time{}, false},
+	}
+	for _, c := range nextCases {
+		next, ok := s.NextOpen(c.t)
+		if !next.Equal(c.next) || ok != c.ok {
+			t.Errorf("NextOpen(%v) = %v, %v; expected %v, %v",
+				c.t, next, ok, c.next, c.ok)
+		}
+	}
+}
+
+func TestScheduleWithoutWindows(t *testing.T) {
+	s, err := parseSchedule("not_after 2024-01-01T10:00:00Z\n")
+	if err != nil {
+		t.Fatalf("parseSchedule: %v", err)
+	}
+
+	limit := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	if err := s.Check(limit.Add(-time.Hour)); err != nil {
+		t.Errorf("denied before not_after: %v", err)
+	}
+	if err := s.Check(limit.Add(time.Second)); err == nil {
+		t.Errorf("allowed after not_after")
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	invalid := []string{
+		"timezone Nowhere/Special",
+		"not_before yesterday",
+		"window mon 02:00",
+		"window xyz 02:00-04:00",
+		"window mon-fri 02:00-25:00",
+		"window mon-fri 02:60-03:00",
+		"window mon-fri",
+		"unknown",
+	}
+	for _, contents := range invalid {
+		if _, err := parseSchedule(contents); err == nil {
+			t.Errorf("%q: parsed without errors", contents)
+		}
+	}
+}
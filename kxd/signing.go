@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
+)
+
+var signingKeyFile = flag.String(
+	"signing_key", "",
+	"File with the ed25519 private key to sign the keys given out with, "+
+		"in PEM format (keys are not signed if empty)")
+
+// Key to sign the keys with, nil if signing is disabled.
+var signingKey ed25519.PrivateKey
+
+// loadSigningKey loads an ed25519 private key from the given PEM file (as
+// created by "openssl genpkey -algorithm ed25519").
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := keymem.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer keymem.Wipe(contents)
+
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+	defer clear(block.Bytes)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	keymem.Lock(edKey)
+	return edKey, nil
+}
+
+// signedMessage returns the message we sign for a key given to a client:
+// the key's path, version (0 if it has none), the client's certificate
+// fingerprint, the time of the signature (in seconds since the epoch), and
+// the SHA-256 of the key.
+//
+// The key only goes in as its hash, so the message and signature can be
+// logged and checked later on without exposing the key.
+//
+// This must match kxc's signedMessage.
+func signedMessage(keyPath string, version int, clientFP string,
+	ts int64, keyData []byte) []byte {
+	sum := sha256.Sum256(keyData)
+	return []byte(fmt.Sprintf("kxd key signature v1\n"+
+		"path: %q\nversion: %d\nclient: %s\ntime: %d\nkey: %x\n",
+		keyPath, version, clientFP, ts, sum))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func writeSigningKey(t *testing.T, path string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	writeSigningKey(t, dir+"/ed25519.pem", priv)
+	key, err := loadSigningKey(dir + "/ed25519.pem")
+	if err != nil || !key.Equal(priv) {
+		t.Errorf("loadSigningKey = %v, %v", key, err)
+	}
+
+	// Other kinds of keys are rejected.
+	writeSigningKey(t, dir+"/ecdsa.pem", newTestCert(t, "x").PrivateKey)
+	writeFile(t, dir+"/garbage.pem", "garbage\n")
+	for _, name := range []string{"ecdsa.pem", "garbage.pem", "none"} {
+		_, err := loadSigningKey(filepath.Join(dir, name))
+		if err == nil {
+			t.Errorf("loadSigningKey(%s) succeeded", name)
+		}
+	}
+}
+
+func TestSignedReplies(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+
+	s := NewMemStore()
+	s.Set("host/key", "key", []byte("sekrit"))
+	s.Set("host/key", "allowed_clients", []byte(certPEM(cert)))
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	oldStore, oldLockdown, oldSigningKey := keyStore, lockdown, signingKey
+	keyStore, lockdown, signingKey = s, NewLockdown(t.TempDir()), priv
+	defer func() {
+		keyStore, lockdown, signingKey =
+			oldStore, oldLockdown, oldSigningKey
+	}()
+
+	get := func(rawURL string) *httptest.ResponseRecorder {
+		t.Helper()
+		u, _ := url.Parse(rawURL)
+		req := &http.Request{
+			URL:        u,
+			RemoteAddr: "192.0.2.1:1234",
+			TLS: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", rawURL, w.Code, w.Body)
+		}
+		return w
+	}
+
+	fp, key := certFingerprint(cert), []byte("sekrit")
+	check := func(sig []byte, version int, ts int64) {
+		t.Helper()
+		msg := signedMessage("host/key", version, fp, ts, key)
+		if !ed25519.Verify(pub, msg, sig) {
+			t.Errorf("invalid signature %x for %q", sig, msg)
+		}
+
+		// Changing any of the fields must invalidate the signature.
+		for _, other := range [][]byte{
+			signedMessage("host/other", version, fp, ts, key),
+			signedMessage("host/key", version+1, fp, ts, key),
+			signedMessage("host/key", version, "00", ts, key),
+			signedMessage("host/key", version, fp, ts+1, key),
+			signedMessage("host/key", version, fp, ts, []byte("x")),
+		} {
+			if ed25519.Verify(pub, other, sig) {
+				t.Errorf("signature valid for %q", other)
+			}
+		}
+	}
+
+	// Version 1: the signature goes in the headers.
+	w := get("/v1/host/key")
+	sig, err := base64.StdEncoding.DecodeString(
+		w.Header().Get("X-Kxd-Key-Signature"))
+	if err != nil {
+		t.Fatalf("invalid signature header: %v", err)
+	}
+	ts, _ := strconv.ParseInt(
+		w.Header().Get("X-Kxd-Key-Signature-Time"), 10, 64)
+	version, _ := strconv.Atoi(w.Header().Get("X-Kxd-Key-Version"))
+	check(sig, version, ts)
+
+	// Version 2: it goes in the reply.
+	w = get("/v2/host/key")
+	reply := &v2Reply{}
+	if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+		t.Fatalf("invalid JSON %q: %v", w.Body, err)
+	}
+	check(reply.Signature, reply.KeyVersion, reply.SignatureTime)
+}
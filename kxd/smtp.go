@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var smtpTLS = flag.String(
+	"smtp_tls", "opportunistic",
+	"TLS mode for SMTP: 'opportunistic' (use STARTTLS if available), "+
+		"'starttls' (require STARTTLS), 'tls' (implicit TLS, usually "+
+		"on port 465), or 'none'")
+var smtpCA = flag.String(
+	"smtp_ca", "",
+	"File with the CA certificates to verify the SMTP server "+
+		"(defaults to the system's)")
+var smtpAuth = flag.String(
+	"smtp_auth", "",
+	"SMTP authentication mechanism: 'plain' or 'cram-md5' "+
+		"(no authentication if empty)")
+var smtpCredentials = flag.String(
+	"smtp_credentials", "",
+	"File with the SMTP username and password, one per line")
+var sendmailPath = flag.String(
+	"sendmail", "",
+	"Send emails by piping them to this sendmail-compatible binary, "+
+		"instead of using SMTP")
+
+// Timeout for a whole SMTP transaction, or sendmail run.
+const smtpTimeout = 1 * time.Minute
+
+// mailEnabled returns true if we have a way to send emails.
+func mailEnabled() bool {
+	return *smtpAddr != "" || *sendmailPath != ""
+}
+
+// checkMailFlags validates the mail-related flags, so we detect errors at
+// startup instead of when sending the first email.
+func checkMailFlags() error {
+	switch *smtpTLS {
+	case "opportunistic", "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("unknown --smtp_tls mode %q", *smtpTLS)
+	}
+
+	switch *smtpAuth {
+	case "":
+	case "plain", "cram-md5":
+		if _, _, err := readSMTPCredentials(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown --smtp_auth mechanism %q", *smtpAuth)
+	}
+
+	if *smtpCA != "" {
+		if _, err := smtpTLSConfig(""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendMail sends the given email message.
+func sendMail(from string, to []string, msg []byte) error {
+	if *sendmailPath != "" {
+		return runSendmail(from, msg)
+	}
+	return sendSMTP(*smtpAddr, from, to, msg)
+}
+
+func smtpTLSConfig(host string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: host}
+	if *smtpCA != "" {
+		pemData, err := os.ReadFile(*smtpCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("error parsing %q", *smtpCA)
+		}
+	}
+	return conf, nil
+}
+
+// readSMTPCredentials reads the username and password from the credentials
+// file. We read it every time, so it can be updated without restarting.
+func readSMTPCredentials() (user, password string, err error) {
+	if *smtpCredentials == "" {
+		return "", "", errors.New("--smtp_auth requires --smtp_credentials")
+	}
+
+	contents, err := os.ReadFile(*smtpCredentials)
+	if err != nil {
+		return "", "", err
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("%q: expected username and password",
+			*smtpCredentials)
+	}
+
+	return strings.TrimSpace(lines[0]),
+		strings.TrimRight(lines[1], "\r"), nil
+}
+
+// sendSMTP sends the message to the given SMTP server, using the TLS and
+// authentication options given by the flags.
+func sendSMTP(addr, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	tlsConf, err := smtpTLSConfig(host)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if *smtpTLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if *smtpTLS == "opportunistic" || *smtpTLS == "starttls" {
+		hasStartTLS, _ := c.Extension("STARTTLS")
+		if hasStartTLS {
+			if err = c.StartTLS(tlsConf); err != nil {
+				return err
+			}
+		} else if *smtpTLS == "starttls" {
+			return errors.New("server does not support STARTTLS")
+		}
+	}
+
+	if *smtpAuth != "" {
+		user, password, err := readSMTPCredentials()
+		if err != nil {
+			return err
+		}
+
+		var auth smtp.Auth
+		if *smtpAuth == "plain" {
+			auth = smtp.PlainAuth("", user, password, host)
+		} else {
+			auth = smtp.CRAMMD5Auth(user, password)
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// runSendmail sends the message by piping it to "sendmail -t", which takes
+// the recipients from the message headers.
+func runSendmail(from string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), smtpTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, *sendmailPath, "-t", "-i", "-f", from)
+	cmd.Env = baseHookEnv()
+	cmd.Stdin = bytes.NewReader(msg)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sendmail failed: %v -- output: %q", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP is a minimal SMTP server for testing, which supports STARTTLS,
+// implicit TLS, and PLAIN and CRAM-MD5 authentication.
+type fakeSMTP struct {
+	l    net.Listener
+	addr string
+
+	// TLS configuration; if set, STARTTLS is advertised (unless
+	// implicitTLS is set, in which case the connections start with TLS).
+	tlsConf     *tls.Config
+	implicitTLS bool
+
+	// If set, AUTH is advertised and required.
+	user, password string
+
+	// Received messages, and the state of the connection at the time.
+	mails chan fakeMail
+}
+
+type fakeMail struct {
+	from   string
+	to     []string
+	data   string
+	tls    bool
+	authed bool
+}
+
+// newFakeSMTP returns a new fake server, listening but not yet accepting
+// connections. The caller should configure it, and then call start.
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return &fakeSMTP{
+		l:     l,
+		addr:  l.Addr().String(),
+		mails: make(chan fakeMail, 10),
+	}
+}
+
+// start begins accepting connections. The configuration must not be
+// changed afterwards.
+func (s *fakeSMTP) start() {
+	go func() {
+		for {
+			conn, err := s.l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	isTLS := false
+	if s.implicitTLS {
+		conn = tls.Server(conn, s.tlsConf)
+		isTLS = true
+	}
+	tc := textproto.NewConn(conn)
+
+	authed := false
+	mail := fakeMail{}
+	tc.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			ext := []string{"fake"}
+			if s.tlsConf != nil && !isTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			if s.user != "" {
+				ext = append(ext, "AUTH PLAIN CRAM-MD5")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				tc.PrintfLine("250%s%s", sep, e)
+			}
+		case "STARTTLS":
+			tc.PrintfLine("220 go ahead")
+			conn = tls.Server(conn, s.tlsConf)
+			tc = textproto.NewConn(conn)
+			isTLS = true
+		case "AUTH":
+			authed = s.auth(tc, arg)
+			if authed {
+				tc.PrintfLine("235 welcome")
+			} else {
+				tc.PrintfLine("535 go away")
+			}
+		case "MAIL":
+			if s.user != "" && !authed {
+				tc.PrintfLine("530 authentication required")
+				continue
+			}
+			mail = fakeMail{tls: isTLS, authed: authed}
+			mail.from = strings.Trim(arg[len("FROM:"):], "<>")
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			rcpt := strings.Trim(arg[len("TO:"):], "<>")
+			mail.to = append(mail.to, rcpt)
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			data, _ := io.ReadAll(tc.DotReader())
+			mail.data = string(data)
+			s.mails <- mail
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) auth(tc *textproto.Conn, arg string) bool {
+	mech, resp, _ := strings.Cut(arg, " ")
+	switch mech {
+	case "PLAIN":
+		dec, _ := base64.StdEncoding.DecodeString(resp)
+		return string(dec) == "\x00"+s.user+"\x00"+s.password
+	case "CRAM-MD5":
+		challenge := "<1234@fake>"
+		tc.PrintfLine("334 %s",
+			base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, _ := tc.ReadLine()
+		dec, _ := base64.StdEncoding.DecodeString(line)
+		mac := hmac.New(md5.New, []byte(s.password))
+		mac.Write([]byte(challenge))
+		return string(dec) == s.user+" "+hex.EncodeToString(mac.Sum(nil))
+	}
+	return false
+}
+
+// setupTLS configures the fake server to use TLS, and writes its
+// certificate to a file to be used as --smtp_ca.
+func setupTLS(t *testing.T, s *fakeSMTP) {
+	cert := newTestCert(t, "smtp")
+	s.tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	caPath := t.TempDir() + "/ca.pem"
+	caPEM := pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(caPath, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, smtpCA, caPath)
+}
+
+func setupCredentials(t *testing.T, user, password string) {
+	path := t.TempDir() + "/credentials"
+	content := fmt.Sprintf("%s\n%s\n", user, password)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, smtpCredentials, path)
+}
+
+func sendTestMail(t *testing.T, s *fakeSMTP) (fakeMail, error) {
+	t.Helper()
+	err := sendSMTP(s.addr, "kxd@test", []string{"a@test", "b@test"},
+		[]byte("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		return fakeMail{}, err
+	}
+
+	mail := <-s.mails
+	if mail.from != "kxd@test" || len(mail.to) != 2 ||
+		!strings.Contains(mail.data, "body") {
+		t.Errorf("unexpected mail: %+v", mail)
+	}
+	return mail, nil
+}
+
+func TestSMTPPlain(t *testing.T) {
+	s := newFakeSMTP(t)
+	s.start()
+
+	setFlag(t, smtpTLS, "opportunistic")
+	mail, err := sendTestMail(t, s)
+	if err != nil || mail.tls {
+		t.Errorf("opportunistic without STARTTLS: %v, %+v", err, mail)
+	}
+
+	setFlag(t, smtpTLS, "starttls")
+	if _, err := sendTestMail(t, s); err == nil {
+		t.Errorf("required STARTTLS not available, but no error")
+	}
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	s := newFakeSMTP(t)
+	setupTLS(t, s)
+	s.start()
+
+	for _, mode := range []string{"opportunistic", "starttls"} {
+		setFlag(t, smtpTLS, mode)
+		mail, err := sendTestMail(t, s)
+		if err != nil || !mail.tls {
+			t.Errorf("%s: %v, %+v", mode, err, mail)
+		}
+	}
+
+	setFlag(t, smtpTLS, "none")
+	mail, err := sendTestMail(t, s)
+	if err != nil || mail.tls {
+		t.Errorf("none: %v, %+v", err, mail)
+	}
+
+	// The server certificate is not trusted by the system CAs, so it
+	// should fail verification.
+	setFlag(t, smtpTLS, "starttls")
+	setFlag(t, smtpCA, "")
+	if _, err := sendTestMail(t, s); err == nil {
+		t.Errorf("untrusted certificate was accepted")
+	}
+}
+
+func TestSMTPImplicitTLSAuth(t *testing.T) {
+	s := newFakeSMTP(t)
+	setupTLS(t, s)
+	s.implicitTLS = true
+	s.user, s.password = "user", "secret"
+	s.start()
+
+	setFlag(t, smtpTLS, "tls")
+
+	for _, mech := range []string{"plain", "cram-md5"} {
+		setFlag(t, smtpAuth, mech)
+		setupCredentials(t, "user", "secret")
+		mail, err := sendTestMail(t, s)
+		if err != nil || !mail.tls || !mail.authed {
+			t.Errorf("%s: %v, %+v", mech, err, mail)
+		}
+
+		setupCredentials(t, "user", "wrong")
+		if _, err := sendTestMail(t, s); err == nil {
+			t.Errorf("%s: wrong password, but no error", mech)
+		}
+	}
+
+	// Without authentication, the server rejects the message.
+	setFlag(t, smtpAuth, "")
+	if _, err := sendTestMail(t, s); err == nil {
+		t.Errorf("unauthenticated, but no error")
+	}
+}
+
+func TestCheckMailFlags(t *testing.T) {
+	if err := checkMailFlags(); err != nil {
+		t.Errorf("default flags: %v", err)
+	}
+
+	setFlag(t, smtpTLS, "maybe")
+	if err := checkMailFlags(); err == nil {
+		t.Errorf("invalid --smtp_tls accepted")
+	}
+	setFlag(t, smtpTLS, "tls")
+
+	setFlag(t, smtpAuth, "plain")
+	if err := checkMailFlags(); err == nil {
+		t.Errorf("--smtp_auth without credentials accepted")
+	}
+	setupCredentials(t, "user", "pass")
+	if err := checkMailFlags(); err != nil {
+		t.Errorf("valid auth flags: %v", err)
+	}
+}
+
+func TestSendmail(t *testing.T) {
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/args\n"+
+		"cat > %s/msg\n", dir, dir)
+	err := os.WriteFile(dir+"/sendmail", []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, sendmailPath, dir+"/sendmail")
+
+	err = sendMail("kxd@test", []string{"a@test"}, []byte("To: a@test\n"))
+	if err != nil {
+		t.Fatalf("sendMail: %v", err)
+	}
+
+	args, _ := os.ReadFile(dir + "/args")
+	msg, _ := os.ReadFile(dir + "/msg")
+	if string(args) != "-t -i -f kxd@test\n" ||
+		string(msg) != "To: a@test\n" {
+		t.Errorf("unexpected sendmail call: %q %q", args, msg)
+	}
+
+	setFlag(t, sendmailPath, "/bin/false")
+	if err := sendMail("kxd@test", nil, nil); err == nil {
+		t.Errorf("failing sendmail, but no error")
+	}
+}
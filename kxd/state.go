@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// keyStateDir is a directory with some state for each key, stored as JSON
+// files at the key's path (e.g. "host/key.json"), so it survives restarts.
+type keyStateDir string
+
+func (d keyStateDir) path(keyPath string) string {
+	return filepath.Join(string(d), filepath.FromSlash(keyPath)+".json")
+}
+
+// load the state of the given key into v. If there is none, v is left
+// untouched.
+func (d keyStateDir) load(keyPath string, v interface{}) error {
+	buf, err := os.ReadFile(d.path(keyPath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// save the state of the given key, replacing the previous one.
+func (d keyStateDir) save(keyPath string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path(keyPath), buf)
+}
+
+// remove the state of the given key, if any.
+func (d keyStateDir) remove(keyPath string) error {
+	err := os.Remove(d.path(keyPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes the data to the given file atomically, by writing
+// to a temporary file and renaming it. Parent directories are created as
+// needed.
+//
+// Files written this way are kxd's own state, so they are only readable by
+// its user.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
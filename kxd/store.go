@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/kxd/internal/keymem"
+)
+
+// Store is where the keys and their configuration are kept.
+//
+// Keys are identified by their path (e.g. "host/key"). Each key has its
+// contents, and a set of configuration files (e.g. "allowed_clients"),
+// identified by name.
+type Store interface {
+	// Keys returns the paths of all the keys, sorted.
+	Keys() ([]string, error)
+
+	// HasKey returns whether the key exists.
+	HasKey(keyPath string) (bool, error)
+
+	// ReadKey returns the contents of the key. It may be expensive (e.g.
+	// run a command), so it should only be called once the request is
+	// authorized. The caller wipes the returned buffer (with keymem.Wipe)
+	// when done with it, so it must not be shared.
+	ReadKey(keyPath string) ([]byte, error)
+
+	// ReadFile returns the contents of the key's configuration file with
+	// the given name. If it doesn't exist, the error satisfies
+	// os.IsNotExist.
+	ReadFile(keyPath, name string) ([]byte, error)
+
+	// Stat returns information about the key, without reading it.
+	Stat(keyPath string) (*KeyStat, error)
+
+	// Digest returns the size and hash of the key if it is static (like a
+	// key file), or nil if it is produced on request (by a command, or
+	// derived). It never produces the key.
+	Digest(keyPath string) (*KeyDigest, error)
+
+	// String describes the store, for humans.
+	String() string
+}
+
+// KeyStat is information about a key, as returned by Store.Stat.
+type KeyStat struct {
+	// Where the key comes from: "file", "command", "derived" or "memory".
+	Source string
+
+	// Version of derived keys, 0 for the others.
+	Version int
+
+	// When the key was last changed, zero if unknown.
+	ModTime time.Time
+}
+
+// KeyDigest is the size and SHA-256 of a key, as returned by Store.Digest.
+type KeyDigest struct {
+	Size   int
+	SHA256 [sha256.Size]byte
+}
+
+func newKeyDigest(key []byte) *KeyDigest {
+	return &KeyDigest{Size: len(key), SHA256: sha256.Sum256(key)}
+}
+
+// The global key store.
+var keyStore Store
+
+// DirStore is a Store backed by a directory, with one subdirectory per key
+// (e.g. "host/key/"), containing the key itself in the "key" file, and the
+// configuration files next to it. This is kxd's traditional layout.
+//
+// Instead of the "key" file, there can be an executable "key_command" file,
+// whose output is the key (see runKeyCommand); or the key can be derived
+// from the master secret, if there is a "derive" file in its directory or in
+// any of its parents (see deriveKey). In the latter case, every directory
+// below the one with the "derive" file is a key.
+type DirStore struct {
+	Dir string
+
+	// Secret to derive keys from, nil if derived keys are disabled.
+	MasterSecret []byte
+}
+
+// NewDirStore returns a new DirStore for the given directory.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+func (s *DirStore) path(keyPath, name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(keyPath), name)
+}
+
+func isDir(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return fi.IsDir(), nil
+}
+
+func isRegular(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return fi.Mode().IsRegular(), nil
+}
+
+// HasKey checks if the key's directory exists, and contains a key file (or
+// a key command), or the key is derived.
+func (s *DirStore) HasKey(keyPath string) (bool, error) {
+	// The root is never a key, even if there's a "derive" file in it; and
+	// neither are the groups.
+	if keyPath == "" || keyPath == "." || isGroupsPath(keyPath) {
+		return false, nil
+	}
+
+	isDir, err := isDir(s.path(keyPath, ""))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !isDir {
+		return false, nil
+	}
+
+	for _, name := range []string{"key", "key_command"} {
+		isRegular, err := isRegular(s.path(keyPath, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if isRegular {
+			return true, nil
+		}
+	}
+
+	derivePath, err := s.findDerive(keyPath)
+	return derivePath != "", err
+}
+
+// ReadKey returns the contents of the key file or, if there is none, the
+// output of the key command or, if there is none either, the derived key.
+func (s *DirStore) ReadKey(keyPath string) ([]byte, error) {
+	key, err := keymem.ReadFile(s.path(keyPath, "key"))
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+
+	cmdPath := s.path(keyPath, "key_command")
+	if _, err := os.Stat(cmdPath); !os.IsNotExist(err) {
+		if err != nil {
+			return nil, err
+		}
+		return runKeyCommand(cmdPath, keyPath)
+	}
+
+	derivePath, err := s.findDerive(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if derivePath == "" {
+		return nil, &fs.PathError{
+			Op:   "read",
+			Path: s.path(keyPath, "key"),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return s.readDerivedKey(keyPath, derivePath)
+}
+
+// ReadFile returns the contents of the file in the key's directory.
+func (s *DirStore) ReadFile(keyPath, name string) ([]byte, error) {
+	return os.ReadFile(s.path(keyPath, name))
+}
+
+// Stat returns information about the key. The modification time is the one
+// of the key file or, for derived keys, the one of the "derive" file (as
+// it changes when the version is bumped). It is unknown for key commands.
+func (s *DirStore) Stat(keyPath string) (*KeyStat, error) {
+	fi, err := os.Stat(s.path(keyPath, "key"))
+	if err == nil {
+		return &KeyStat{Source: "file", ModTime: fi.ModTime()}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, err = os.Stat(s.path(keyPath, "key_command"))
+	if err == nil {
+		return &KeyStat{Source: "command"}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	derivePath, err := s.findDerive(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if derivePath == "" {
+		return nil, &fs.PathError{
+			Op:   "stat",
+			Path: s.path(keyPath, "key"),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	p, err := readDeriveParams(derivePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err = os.Stat(derivePath)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStat{
+		Source:  "derived",
+		Version: p.Version,
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// Keys returns the paths of all the directories that contain a key (or a
+// key command), or whose key is derived. If the
+// directory doesn't exist, there are no keys.
+func (s *DirStore) Keys() ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(s.Dir,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil && path == s.Dir && os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || !d.IsDir() {
+				return err
+			}
+			keyPath, _ := filepath.Rel(s.Dir, path)
+			keyPath = filepath.ToSlash(keyPath)
+			if exists, _ := s.HasKey(keyPath); exists {
+				keys = append(keys, keyPath)
+			}
+			return nil
+		})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// Digest returns the size and hash of the key file, or nil if there is
+// none (the key comes from a command, or is derived).
+func (s *DirStore) Digest(keyPath string) (*KeyDigest, error) {
+	key, err := keymem.ReadFile(s.path(keyPath, "key"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer keymem.Wipe(key)
+	return newKeyDigest(key), nil
+}
+
+func (s *DirStore) String() string {
+	return "directory " + s.Dir
+}
+
+// MemStore is a Store that keeps everything in memory. It is mostly useful
+// for testing.
+type MemStore struct {
+	mu sync.RWMutex
+
+	// Files of each key, by name. The key itself is the "key" file.
+	keys map[string]map[string][]byte
+
+	// When each key was last set.
+	modTimes map[string]time.Time
+}
+
+// NewMemStore returns a new, empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		keys:     map[string]map[string][]byte{},
+		modTimes: map[string]time.Time{},
+	}
+}
+
+// Set the contents of the key's file with the given name. Use "key" to
+// set the key itself.
+func (s *MemStore) Set(keyPath, name string, contents []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys[keyPath] == nil {
+		s.keys[keyPath] = map[string][]byte{}
+	}
+	s.keys[keyPath][name] = contents
+	if name == "key" {
+		s.modTimes[keyPath] = time.Now()
+	}
+}
+
+// Keys returns the paths of all the keys that have their contents set.
+func (s *MemStore) Keys() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []string{}
+	for keyPath, files := range s.keys {
+		if _, ok := files["key"]; ok && !isGroupsPath(keyPath) {
+			keys = append(keys, keyPath)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// HasKey returns whether the key's contents are set.
+func (s *MemStore) HasKey(keyPath string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.keys[keyPath]["key"]
+	return ok && !isGroupsPath(keyPath), nil
+}
+
+// ReadKey returns the contents of the key.
+func (s *MemStore) ReadKey(keyPath string) ([]byte, error) {
+	return s.ReadFile(keyPath, "key")
+}
+
+// ReadFile returns the contents of the key's file with the given name.
+func (s *MemStore) ReadFile(keyPath, name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	contents, ok := s.keys[keyPath][name]
+	if !ok {
+		return nil, &fs.PathError{
+			Op:   "read",
+			Path: strings.TrimPrefix(keyPath+"/"+name, "/"),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return append([]byte(nil), contents...), nil
+}
+
+// Stat returns information about the key.
+func (s *MemStore) Stat(keyPath string) (*KeyStat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.keys[keyPath]["key"]; !ok {
+		return nil, &fs.PathError{
+			Op:   "stat",
+			Path: keyPath,
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return &KeyStat{Source: "memory", ModTime: s.modTimes[keyPath]}, nil
+}
+
+// Digest returns the size and hash of the key. Keys in memory are always
+// static.
+func (s *MemStore) Digest(keyPath string) (*KeyDigest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[keyPath]["key"]
+	if !ok {
+		return nil, &fs.PathError{
+			Op:   "digest",
+			Path: keyPath,
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return newKeyDigest(key), nil
+}
+
+func (s *MemStore) String() string {
+	return "memory"
+}
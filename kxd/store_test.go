@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir+"/k1/key", "k1")
+	writeFile(t, dir+"/host/k2/key", "k2")
+	writeFile(t, dir+"/host/k2/email_to", "me@example.com")
+	writeFile(t, dir+"/nokey/email_to", "me@example.com")
+
+	s := NewDirStore(dir)
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	if expected := []string{"host/k2", "k1"}; !reflect.DeepEqual(
+		keys, expected) {
+		t.Errorf("Keys = %v, expected %v", keys, expected)
+	}
+
+	if ok, err := s.HasKey("host/k2"); !ok || err != nil {
+		t.Errorf("HasKey(host/k2) = %v, %v", ok, err)
+	}
+	if ok, err := s.HasKey("nokey"); ok || err != nil {
+		t.Errorf("HasKey(nokey) = %v, %v", ok, err)
+	}
+	if key, err := s.ReadKey("host/k2"); string(key) != "k2" || err != nil {
+		t.Errorf("ReadKey(host/k2) = %q, %v", key, err)
+	}
+	if _, err := s.ReadFile("k1", "email_to"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of missing file returned %v", err)
+	}
+
+	// A missing directory has no keys.
+	keys, err = NewDirStore(dir + "/missing").Keys()
+	if len(keys) != 0 || err != nil {
+		t.Errorf("Keys on missing directory = %v, %v", keys, err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	s.Set("host/k2", "key", []byte("k2"))
+	s.Set("host/k2", "email_to", []byte("me@example.com"))
+	s.Set("k1", "key", []byte("k1"))
+	s.Set("nokey", "email_to", []byte("me@example.com"))
+
+	keys, _ := s.Keys()
+	if expected := []string{"host/k2", "k1"}; !reflect.DeepEqual(
+		keys, expected) {
+		t.Errorf("Keys = %v, expected %v", keys, expected)
+	}
+
+	if ok, _ := s.HasKey("nokey"); ok {
+		t.Errorf("HasKey(nokey) = true")
+	}
+	kc := NewKeyConfig(s, "host/k2")
+	if emails, err := kc.EmailTo(); len(emails) != 1 || err != nil {
+		t.Errorf("EmailTo = %v, %v", emails, err)
+	}
+	if _, err := s.ReadFile("k1", "email_to"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of missing file returned %v", err)
+	}
+}
+
+func TestHandlerMemStore(t *testing.T) {
+	cert := newTestCert(t, "client").Leaf
+	other := newTestCert(t, "other").Leaf
+
+	s := NewMemStore()
+	s.Set("host/key", "key", []byte("sekrit"))
+	s.Set("host/key", "allowed_clients", pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	oldStore, oldLockdown := keyStore, lockdown
+	keyStore, lockdown = s, NewLockdown(t.TempDir())
+	defer func() { keyStore, lockdown = oldStore, oldLockdown }()
+
+	get := func(key string,
+		cert *x509.Certificate) *httptest.ResponseRecorder {
+		t.Helper()
+		req := newTestRequest(key, "192.0.2.1:1234").Request
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		}
+		w := httptest.NewRecorder()
+		KeyHandler(w, req)
+		return w
+	}
+
+	if w := get("host/key", cert); w.Code != http.StatusOK ||
+		w.Body.String() != "sekrit" {
+		t.Errorf("allowed client got %d %q", w.Code, w.Body.String())
+	}
+	if w := get("host/key", other); w.Code != http.StatusForbidden {
+		t.Errorf("other client got %d, expected 403", w.Code)
+	}
+	if w := get("host/nokey", cert); w.Code != http.StatusNotFound {
+		t.Errorf("unknown key got %d, expected 404", w.Code)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	htemplate "html/template"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+)
+
+var templatesDir = flag.String(
+	"templates_dir", "/etc/kxd/templates",
+	"Directory with the notification templates "+
+		"(the built-in ones are used if missing)")
+
+// Names of the template files, both in the templates directory, and in the
+// per-key directories.
+const (
+	emailTextTmplFile = "email.tmpl"
+	emailHTMLTmplFile = "email.html"
+)
+
+// Built-in template for the email text, used if there is no email.tmpl.
+// Note the email headers are added by kxd, except for the subject which
+// comes from the "subject" template.
+const emailTmplBody = (`{{if eq .Event "key_denied" -}}
+Access DENIED to key: {{.Key}}
+Reason: {{.Reason}}
+{{else -}}
+Key: {{.Key}}
+{{end -}}
+Accessed by: {{.Req.RemoteAddr}}
+On: {{.TimeString}}
+{{- if .Req.ID}}
+Request ID: {{.Req.ID}}
+{{- end}}
+
+Client certificate:
+  Signature: {{printf "%.16s" (printf "%x" .Cert.Signature)}}...
+  Subject: {{.Cert.Subject}}
+
+{{if eq .Event "key_denied"}}Presented chain:{{else}}Authorizing chains:{{end}}
+{{range .Chains}}  {{ChainToString .}}
+{{end}}
+{{if .Suppressed -}}
+{{.Suppressed}} other denials from this source were not notified.
+{{end}}
+{{define "subject"}}{{if eq .Event "key_denied"}}Denied access{{else}}Access{{end}} to key {{.Key}}{{end}}`)
+
+var templateFuncs = map[string]interface{}{
+	"ChainToString": ChainToString,
+}
+
+// emailTemplates holds the templates used to compose an email.
+type emailTemplates struct {
+	// Template for the text version; it also must define "subject".
+	text *template.Template
+
+	// Template for the HTML version, nil if there isn't one.
+	html *htemplate.Template
+}
+
+// Loaded templates, protected by templatesMu.
+var (
+	templatesMu sync.RWMutex
+
+	// Templates to use by default.
+	globalTemplates *emailTemplates
+
+	// Per-key templates, indexed by key path. Only for keys which override
+	// at least one of the templates.
+	keyTemplates map[string]*emailTemplates
+)
+
+func init() {
+	globalTemplates = builtinTemplates()
+}
+
+func builtinTemplates() *emailTemplates {
+	text := template.New(emailTextTmplFile).Funcs(templateFuncs)
+	template.Must(text.Parse(emailTmplBody))
+	return &emailTemplates{text: text}
+}
+
+// templatesFor returns the templates to use for the given key.
+func templatesFor(keyPath string) *emailTemplates {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	if et, ok := keyTemplates[keyPath]; ok {
+		return et
+	}
+	return globalTemplates
+}
+
+// override returns a copy of the templates, with the ones returned by read
+// (given the template file name) replacing the existing ones.
+func (et *emailTemplates) override(
+	read func(name string) ([]byte, error)) (*emailTemplates, bool, error) {
+	newET := *et
+	found := false
+
+	if contents, err := read(emailTextTmplFile); err == nil {
+		found = true
+		newET.text, err = template.New(emailTextTmplFile).
+			Funcs(templateFuncs).Parse(string(contents))
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Use the default subject if the template doesn't define one.
+		if newET.text.Lookup("subject") == nil {
+			subject := et.text.Lookup("subject")
+			_, err = newET.text.AddParseTree("subject", subject.Tree)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	if contents, err := read(emailHTMLTmplFile); err == nil {
+		found = true
+		newET.html, err = htemplate.New(emailHTMLTmplFile).
+			Funcs(templateFuncs).Parse(string(contents))
+		if err != nil {
+			return nil, false, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	if found {
+		// Check they can be executed, to catch errors like references to
+		// unknown fields now, instead of when sending an email.
+		if _, err := newET.Render(sampleEmailBody()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &newET, found, nil
+}
+
+// LoadTemplates loads the templates from the templates directory, and the
+// per-key overrides from the given store. If there are any errors, the
+// currently loaded templates are left untouched.
+func LoadTemplates(store Store) error {
+	global, _, err := builtinTemplates().override(
+		func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(*templatesDir, name))
+		})
+	if err != nil {
+		return fmt.Errorf("%s: %v", *templatesDir, err)
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		return err
+	}
+
+	perKey := map[string]*emailTemplates{}
+	for _, keyPath := range keys {
+		et, found, err := global.override(
+			func(name string) ([]byte, error) {
+				return store.ReadFile(keyPath, name)
+			})
+		if err != nil {
+			return fmt.Errorf("%s: %v", keyPath, err)
+		}
+		if found {
+			perKey[keyPath] = et
+		}
+	}
+
+	templatesMu.Lock()
+	globalTemplates = global
+	keyTemplates = perKey
+	templatesMu.Unlock()
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// resetTemplates restores the built-in templates at the end of the test.
+func resetTemplates(t *testing.T) {
+	t.Cleanup(func() {
+		globalTemplates = builtinTemplates()
+		keyTemplates = nil
+	})
+}
+
+func renderFor(t *testing.T, key string) string {
+	t.Helper()
+	body := sampleEmailBody()
+	body.Key = key
+	msg, err := templatesFor(key).Render(body)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	return string(msg)
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	resetTemplates(t)
+	setFlag(t, templatesDir, "/does/not/exist")
+	if err := LoadTemplates(NewMemStore()); err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+
+	msg := renderFor(t, "host/key")
+	expected := []string{
+		"From: Key Exchange Daemon <kxd@example.com>\n",
+		"To: someone@example.com\n",
+		"Subject: Access to key host/key\n\nKey: host/key\n",
+		"Accessed by: 192.0.2.1:1234\n",
+		"Request ID: 0123456789abcdef\n\nClient certificate:\n",
+		"  Subject: CN=client\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(msg, e) {
+			t.Errorf("message does not contain %q:\n%s", e, msg)
+		}
+	}
+	if strings.Contains(msg, "MIME-Version") {
+		t.Errorf("text-only message is multipart:\n%s", msg)
+	}
+
+	// Denials use the same templates.
+	body := sampleEmailBody()
+	body.Event = EventKeyDenied
+	body.Reason = "Host not allowed"
+	body.Suppressed = 3
+	buf, err := templatesFor("host/key").Render(body)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	msg = string(buf)
+	expected = []string{
+		"Subject: Denied access to key host/key\n\n",
+		"Access DENIED to key: host/key\nReason: Host not allowed\n",
+		"Presented chain:\n",
+		"3 other denials from this source were not notified.\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(msg, e) {
+			t.Errorf("message does not contain %q:\n%s", e, msg)
+		}
+	}
+}
+
+func TestCustomTemplates(t *testing.T) {
+	resetTemplates(t)
+	tmplDir := t.TempDir()
+	setFlag(t, templatesDir, tmplDir)
+	data := t.TempDir()
+
+	writeFile(t, tmplDir+"/email.tmpl",
+		`{{define "subject"}}Key {{.Key}} used by {{.ClientLabels.CN}}`+
+			"\n{{end}}Global text for {{.Key}} ({{.Network.IP}})")
+	writeFile(t, tmplDir+"/email.html",
+		`<p>Global HTML for {{.Key}} & <b>{{.KeyLabels.label}}</b></p>`)
+
+	// Key that overrides the text template, but not the subject, so the
+	// global one is used.
+	writeFile(t, data+"/host/k1/key", "k1")
+	writeFile(t, data+"/host/k1/email.tmpl", "Text for k1")
+
+	// Key that overrides only the HTML template.
+	writeFile(t, data+"/host/k2/key", "k2")
+	writeFile(t, data+"/host/k2/email.html", "<p>HTML for k2</p>")
+
+	if err := LoadTemplates(NewDirStore(data)); err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+
+	cases := []struct {
+		key      string
+		expected []string
+	}{
+		{"other", []string{
+			"Subject: Key other used by client\n",
+			"MIME-Version: 1.0\n",
+			"Content-Type: multipart/alternative;",
+			"Global text for other (192.0.2.1)",
+			"<p>Global HTML for other & <b>value</b></p>",
+		}},
+		{"host/k1", []string{
+			"Subject: Key host/k1 used by client\n",
+			"Text for k1",
+			"<p>Global HTML for host/k1",
+		}},
+		{"host/k2", []string{
+			"Subject: Key host/k2 used by client\n",
+			"Global text for host/k2",
+			"<p>HTML for k2</p>",
+		}},
+	}
+	for _, c := range cases {
+		msg := renderFor(t, c.key)
+		for _, e := range c.expected {
+			if !strings.Contains(msg, e) {
+				t.Errorf("%q: message does not contain %q:\n%s",
+					c.key, e, msg)
+			}
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	resetTemplates(t)
+	tmplDir := t.TempDir()
+	setFlag(t, templatesDir, tmplDir)
+	data := t.TempDir()
+	store := NewDirStore(data)
+	writeFile(t, data+"/host/key/key", "key")
+
+	writeFile(t, tmplDir+"/email.tmpl", "Valid for {{.Key}}")
+	if err := LoadTemplates(store); err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+
+	invalid := map[string]string{
+		tmplDir + "/email.tmpl":       "Unclosed {{.Key",
+		tmplDir + "/email.html":       "Unknown {{.NoSuchField}}",
+		data + "/host/key/email.tmpl": "Unknown {{NoSuchFunc}}",
+		data + "/host/key/email.html": "Invalid {{.Key.Foo}}",
+	}
+	for path, contents := range invalid {
+		writeFile(t, path, contents)
+		err := LoadTemplates(store)
+		if err == nil {
+			t.Errorf("%s: invalid template loaded", path)
+		}
+		os.Remove(path)
+
+		// The previous templates must have been kept.
+		if msg := renderFor(t, "host/key"); !strings.Contains(
+			msg, "Valid for host/key") {
+			t.Errorf("%s: templates changed after error:\n%s", path, msg)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var webhookURLs stringList
+
+func init() {
+	flag.Var(&webhookURLs, "webhook_url",
+		"URL to POST notifications to, for all keys (can be repeated)")
+}
+
+var webhookSecretFile = flag.String(
+	"webhook_secret_file", "",
+	"File with the secret used to sign the webhook payloads")
+var webhookTimeout = flag.Duration(
+	"webhook_timeout", 10*time.Second,
+	"Timeout for webhook requests")
+
+// Headers we set in webhook requests.
+const (
+	webhookSignatureHeader = "X-Kxd-Signature"
+	webhookTimestampHeader = "X-Kxd-Timestamp"
+)
+
+// webhookPayload is the JSON object we send to the webhooks.
+type webhookPayload struct {
+	Event      string         `json:"event"`
+	Time       time.Time      `json:"time"`
+	Key        string         `json:"key"`
+	RemoteAddr string         `json:"remote_addr"`
+	RequestID  string         `json:"request_id,omitempty"`
+	Client     *webhookClient `json:"client,omitempty"`
+	Chains     []string       `json:"chains,omitempty"`
+
+	// Only for denials.
+	Reason     string `json:"reason,omitempty"`
+	Suppressed int    `json:"suppressed,omitempty"`
+
+	// Only for bans.
+	Ban *Ban `json:"ban,omitempty"`
+}
+
+type webhookClient struct {
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func newWebhookPayload(ev *Event) *webhookPayload {
+	p := &webhookPayload{
+		Event:      ev.Type,
+		Time:       ev.Time,
+		Key:        ev.Key,
+		RemoteAddr: ev.Req.RemoteAddr,
+		RequestID:  ev.Req.ID,
+		Reason:     ev.Reason,
+		Suppressed: ev.Suppressed,
+		Ban:        ev.Ban,
+	}
+	if ev.Cert != nil {
+		p.Client = &webhookClient{
+			Subject:     ev.Cert.Subject.String(),
+			Fingerprint: certFingerprint(ev.Cert),
+		}
+	}
+	for _, chain := range ev.Chains {
+		p.Chains = append(p.Chains, ChainToString(chain))
+	}
+	return p
+}
+
+// composeWebhooks returns the webhook deliveries for the event on the given
+// key: one per global webhook, and one per webhook configured for the key.
+func composeWebhooks(kc *KeyConfig, ev *Event) ([]*delivery, error) {
+	keyURLs, err := kc.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := append(append([]string{}, webhookURLs...), keyURLs...)
+	return webhookDeliveries(urls, ev)
+}
+
+// webhookDeliveries returns the deliveries of the event to the given
+// webhooks.
+func webhookDeliveries(urls []string, ev *Event) ([]*delivery, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	payload, err := json.Marshal(newWebhookPayload(ev))
+	if err != nil {
+		return nil, err
+	}
+
+	ds := []*delivery{}
+	for _, url := range urls {
+		ds = append(ds, &delivery{
+			Kind: "webhook",
+			URL:  url,
+			Data: payload,
+		})
+	}
+	return ds, nil
+}
+
+// webhookSignature returns the signature for the given payload and
+// timestamp: the hex-encoded HMAC-SHA256 of "<timestamp>.<payload>", using
+// the given secret as key.
+//
+// Including the timestamp allows the receivers to reject old requests, to
+// prevent replays.
+func webhookSignature(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends the payload to the given URL. The payload is signed if
+// there is a secret configured.
+func postWebhook(url string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kxd")
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+
+	if *webhookSecretFile != "" {
+		// Read the secret every time, so it can be changed without
+		// restarting.
+		secret, err := os.ReadFile(*webhookSecretFile)
+		if err != nil {
+			return err
+		}
+		secret = bytes.TrimSpace(secret)
+		req.Header.Set(webhookSignatureHeader,
+			webhookSignature(secret, timestamp, payload))
+	}
+
+	client := &http.Client{Timeout: *webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// webhookStub is a fake webhook receiver, which records the requests it
+// gets.
+type webhookStub struct {
+	status   int
+	payloads []webhookPayload
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (s *webhookStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	p := webhookPayload{}
+	json.Unmarshal(body, &p)
+	s.payloads = append(s.payloads, p)
+	s.headers = append(s.headers, r.Header)
+	s.bodies = append(s.bodies, body)
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+	}
+}
+
+func newTestEvent(t *testing.T, key string) *Event {
+	t.Helper()
+	cert := newTestCert(t, "client").Leaf
+	ev, err := NewEvent(EventKeyGranted,
+		newTestRequest(key, "192.0.2.1:1234"),
+		[][]*x509.Certificate{{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestWebhookNotify(t *testing.T) {
+	globalStub := &webhookStub{}
+	globalSrv := httptest.NewServer(globalStub)
+	defer globalSrv.Close()
+
+	keyStub := &webhookStub{}
+	keySrv := httptest.NewServer(keyStub)
+	defer keySrv.Close()
+
+	old := webhookURLs
+	webhookURLs = stringList{globalSrv.URL}
+	defer func() { webhookURLs = old }()
+
+	secretPath := t.TempDir() + "/secret"
+	writeFile(t, secretPath, "sekrit\n")
+	setFlag(t, webhookSecretFile, secretPath)
+
+	store := NewMemStore()
+	store.Set("host/key", "webhooks",
+		[]byte("# Comment.\n"+keySrv.URL+"/hook\n"))
+	kc := NewKeyConfig(store, "host/key")
+
+	ev := newTestEvent(t, "host/key")
+	if err := Notify(kc, ev); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	for _, stub := range []*webhookStub{globalStub, keyStub} {
+		if len(stub.payloads) != 1 {
+			t.Fatalf("expected 1 payload, got %d", len(stub.payloads))
+		}
+		p := stub.payloads[0]
+		if p.Event != EventKeyGranted || p.Key != "host/key" ||
+			p.RemoteAddr != "192.0.2.1:1234" ||
+			p.Client.Fingerprint != certFingerprint(ev.Cert) ||
+			len(p.Chains) != 1 {
+			t.Errorf("unexpected payload: %+v", p)
+		}
+
+		h := stub.headers[0]
+		expected := webhookSignature([]byte("sekrit"),
+			h.Get(webhookTimestampHeader), stub.bodies[0])
+		if sig := h.Get(webhookSignatureHeader); sig != expected {
+			t.Errorf("wrong signature: got %q, expected %q",
+				sig, expected)
+		}
+	}
+}
+
+func TestWebhookPolicies(t *testing.T) {
+	stub := &webhookStub{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	store := NewMemStore()
+	store.Set("key", "webhooks", []byte(srv.URL+"\n"))
+	kc := NewKeyConfig(store, "key")
+
+	// By default notifications must be delivered, so a failing webhook
+	// causes an error.
+	if err := Notify(kc, newTestEvent(t, "key")); err == nil {
+		t.Errorf("failed webhook did not cause an error")
+	}
+
+	// With the "eventually" policy, they get queued instead.
+	oldSpool := notifySpool
+	notifySpool = NewSpool(t.TempDir())
+	defer func() { notifySpool = oldSpool }()
+
+	store.Set("key", "notify_policy", []byte("eventually\n"))
+	if err := Notify(kc, newTestEvent(t, "key")); err != nil {
+		t.Errorf("Notify: %v", err)
+	}
+	if depth, _ := notifySpool.Stats(); depth != 1 {
+		t.Errorf("expected 1 queued notification, got %d", depth)
+	}
+
+	// Once the webhook works again, it gets delivered.
+	stub.status = 0
+	for _, name := range notifySpool.list() {
+		writeDeliveryDue(t, notifySpool, name)
+	}
+	notifySpool.Process()
+	if depth, _ := notifySpool.Stats(); depth != 0 {
+		t.Errorf("notification still queued after delivery")
+	}
+	if len(stub.payloads) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(stub.payloads))
+	}
+}